@@ -69,7 +69,7 @@ if (window.playground) {
       var data = {
         "src": code[0].value,
         "offset": code[0].selectionStart,
-        "filename": "fill.go"
+        "filename": opts.filename || ""
       };
       window.console.log
       fillRequest = $.ajax("/fill", {
@@ -79,25 +79,61 @@ if (window.playground) {
         success: function(data) {
           fillRequest = null;
           if (data.Error) {
-            window.console.log("fill error: ");
-            window.console.log(data.Error);
-          } else {
-            window.console.log("fill data:");
-            window.console.log(data);
-            fillData = data;
-            var res = [];
-            if (data.Suggest) {
-              for (var i = 0; i < data.Suggest.length; i++) {
-                res.push(data.Suggest[i].Name);
-              }
+            // Incomplete code rarely parses, so errors
+            // do not stop us making suggestions.
+            for (var i = 0; i < data.Error.length; i++) {
+              var e = data.Error[i];
+              window.console.log("fill.go:" + e.Line + ":" + e.Column + ": " + e.Severity + ": " + e.Error);
+            }
+          }
+          window.console.log("fill data:");
+          window.console.log(data);
+          fillData = data;
+          var res = [];
+          if (data.Suggest) {
+            for (var i = 0; i < data.Suggest.length; i++) {
+              res.push(data.Suggest[i].Name);
             }
-            callback(res);
           }
+          callback(res);
         },
         error: function() { callback([]); }
       })
     }
 
+    function showDoc(item) {
+      var doc = $("#doc").empty();
+      doc.append($("<code>").text(item.Kind + " " + item.Name));
+      if (item.Type) {
+        doc.append($("<pre>").text(item.Type));
+      }
+      doc.append($("<p>").text(item.Doc || ""));
+    }
+
+    var hoverRequest = null;
+    function hover() {
+      if (hoverRequest) {
+        hoverRequest.abort();
+      }
+      var code = $(opts.codeEl);
+      hoverRequest = $.ajax("/hover", {
+        data: {
+          "src": code[0].value,
+          "offset": code[0].selectionStart,
+          "filename": opts.filename || ""
+        },
+        type: "POST",
+        dataType: "json",
+        success: function(data) {
+          hoverRequest = null;
+          if (data) {
+            showDoc(data);
+          }
+        }
+      });
+    }
+    $(opts.codeEl).click(hover);
+
     //$(opts.runEl).click(run);
     //$(opts.fmtEl).click(fmt);
     //$(opts.codeEl).bind('input propertychange', function() { window.console.log("propertychange"); });
@@ -120,13 +156,13 @@ if (window.playground) {
         $("#doc").html("");
       },
       'textComplete:activate': function(e, value) {
-        var doc = "";
         var index = parseInt(value.attributes["data-index"].value, 10);
         var suggest = fillData.Suggest[index];
         if (suggest) {
-          doc = suggest.Doc;
+          showDoc(suggest);
+        } else {
+          $("#doc").empty();
         }
-        $("#doc").html(doc);
       },
      });
   }
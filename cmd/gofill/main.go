@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"flag"
+	"go/build"
 	"log"
 	"net/http"
 	"time"
@@ -11,8 +12,10 @@ import (
 )
 
 var (
-	httpAddr = flag.String("http", "localhost:6060", "HTTP service address")
-	verbose  = flag.Bool("v", false, "verbose mode")
+	httpAddr  = flag.String("http", "localhost:6060", "HTTP service address")
+	verbose   = flag.Bool("v", false, "verbose mode")
+	typeCheck = flag.Bool("typecheck", false, "resolve selectors with go/types")
+	module    = flag.String("module", "", "also index the Go module, or go.work workspace, containing this directory")
 	//fs       = vfs.NameSpace{}
 )
 
@@ -21,7 +24,24 @@ func main() {
 
 	log.Printf("gofill service")
 
-	http.Handle("/fill", gofill.SimpleHandler())
+	var h *gofill.Handler
+	if *module != "" {
+		x, err := gofill.ModuleIndexer(*module)
+		if err != nil {
+			log.Fatal(err)
+		}
+		h = gofill.NewHandler(x)
+	} else {
+		h = gofill.SimpleHandler()
+	}
+	if h.Index() == nil {
+		log.Fatalf("cannot index the standard library in GOROOT %s", build.Default.GOROOT)
+	}
+	h.Index().TypeCheck = *typeCheck
+	http.Handle("/fill", h)
+	http.HandleFunc("/definition", h.ServeDefinition)
+	http.HandleFunc("/hover", h.ServeHover)
+	http.HandleFunc("/overlay", h.ServeOverlay)
 
 	startTime := time.Now()
 	for name, content := range gofill.StaticFiles {
@@ -0,0 +1,142 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gofill
+
+import (
+	"go/ast"
+	"go/types"
+)
+
+// A Definition is where a name is declared.
+type Definition struct {
+	Name   string
+	File   string // empty for the queried source
+	Line   int    // 1-based
+	Column int    // 1-based, in bytes
+	Range  Range  // of the name in the queried source, or {-1, -1}
+}
+
+// Definition finds the declaration of the identifier at offset
+// in src, with filename as for Query. It returns nil if the
+// declaration is unknown.
+func (x *Index) Definition(filename, src string, offset int) *Definition {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	query, id, path := x.identQuery(filename, src, offset)
+	if id == nil {
+		return nil
+	}
+	if query.info != nil {
+		if obj := identObj(query.info, id); obj != nil {
+			if def := x.objDefinition(query, obj); def != nil {
+				return def
+			}
+		}
+	}
+	if d := x.identDecl(query, id, path); d != nil {
+		return query.declDefinition(d)
+	}
+	return nil
+}
+
+// identQuery prepares a query about the identifier at offset.
+// The identifier is nil if there is none.
+func (x *Index) identQuery(filename, src string, offset int) (*queryState, *ast.Ident, []ast.Node) {
+	query := x.newQuery(filename, src, offset, Passive)
+	if len(query.path) == 0 {
+		return query, nil, nil
+	}
+	if x.TypeCheck {
+		x.typeCheck(query)
+	}
+	id, path := query.identAt()
+	return query, id, path
+}
+
+// identDecl resolves id syntactically. Names in scope are
+// returned as a decl in the queried file, with only a name
+// and position.
+func (x *Index) identDecl(query *queryState, id *ast.Ident, path []ast.Node) *decl {
+	if isScopeRef(path) {
+		obj, ok := lookupScope(x.pkgs, path)
+		if !ok {
+			return query.localDecl(id.Name)
+		}
+		if obj.declPos.IsValid() {
+			return &decl{name: id.Name, pos: obj.declPos, kind: obj.kind}
+		}
+		return nil
+	}
+	sel, ok := path[1].(*ast.SelectorExpr)
+	if !ok || sel.Sel != id {
+		return nil
+	}
+	if pkgID, ok := sel.X.(*ast.Ident); ok {
+		if pkg := x.importedPkg(query, nil, pkgID.Name); pkg != nil {
+			return pkg.lookup(id.Name)
+		}
+	}
+	var members []*decl
+	if t, ok := x.typeOperand(query, sel.X); ok {
+		members = x.methods(query, t, false)
+	} else {
+		members = x.members(query, x.exprType(query, sel.X, nil))
+	}
+	for _, m := range members {
+		if m.name == id.Name {
+			return m
+		}
+	}
+	return nil
+}
+
+// objDefinition finds the declaration of a go/types object,
+// in the queried package or the index.
+func (x *Index) objDefinition(query *queryState, obj types.Object) *Definition {
+	if obj.Pkg() == nil {
+		return nil // builtin
+	}
+	if obj.Pkg() == query.pkg {
+		if !obj.Pos().IsValid() {
+			return nil
+		}
+		return query.declDefinition(&decl{name: obj.Name(), pos: obj.Pos()})
+	}
+	if d := x.objDecl(obj); d != nil {
+		return query.declDefinition(d)
+	}
+	return nil
+}
+
+func (query *queryState) declDefinition(d *decl) *Definition {
+	if !d.pos.IsValid() {
+		return nil
+	}
+	if d.file == nil && query.inFile(d.pos) {
+		off := query.offsetOf(d.pos)
+		line, col := lineColumn(query.src, off)
+		return &Definition{
+			Name:   d.name,
+			Line:   line,
+			Column: col,
+			Range:  Range{off, off + len(d.name)},
+		}
+	}
+	fset := query.fset // of a sibling file
+	if d.file != nil {
+		fset = d.file.fset
+	}
+	if fset == nil {
+		return nil
+	}
+	p := fset.Position(d.pos)
+	return &Definition{
+		Name:   d.name,
+		File:   p.Filename,
+		Line:   p.Line,
+		Column: p.Column,
+		Range:  Range{-1, -1},
+	}
+}
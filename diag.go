@@ -0,0 +1,77 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gofill
+
+import (
+	"go/scanner"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SeverityError is the Error.Severity of a parse error, the
+// only kind of diagnostic reported so far.
+const SeverityError = "error"
+
+// parseErrors reports each error returned by the parser.
+func (query *queryState) parseErrors(err error) {
+	list, ok := err.(scanner.ErrorList)
+	if !ok {
+		query.res.Error = append(query.res.Error, Error{
+			Range:    Range{-1, -1},
+			Severity: SeverityError,
+			Error:    err.Error(),
+		})
+		return
+	}
+	list.Sort()
+	for i, e := range list {
+		if i > 0 && *e == *list[i-1] {
+			// The parser can repeat itself when recovering.
+			continue
+		}
+		off := e.Pos.Offset
+		if query.fake && off == query.offset {
+			// Complaining about the identifier we inserted.
+			continue
+		}
+		if query.fake && off > query.offset {
+			off--
+		}
+		if off > len(query.src) {
+			off = len(query.src)
+		}
+		line, col := lineColumn(query.src, off)
+		query.res.Error = append(query.res.Error, Error{
+			Range:    Range{off, off + tokenLen(query.src[off:])},
+			Line:     line,
+			Column:   col,
+			Severity: SeverityError,
+			Error:    e.Msg,
+		})
+	}
+}
+
+// tokenLen guesses the length of the token at the start of src,
+// to underline: an identifier or number, or else a single rune.
+func tokenLen(src string) int {
+	n := strings.IndexFunc(src, func(r rune) bool {
+		return r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if n < 0 {
+		return len(src)
+	}
+	if n == 0 && src[0] != '\n' {
+		_, n = utf8.DecodeRuneInString(src)
+	}
+	return n
+}
+
+// lineColumn returns the 1-based line and byte column of off in src.
+func lineColumn(src string, off int) (line, col int) {
+	line = 1 + strings.Count(src[:off], "\n")
+	col = 1 + off - (strings.LastIndex(src[:off], "\n") + 1)
+	return line, col
+}
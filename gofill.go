@@ -6,12 +6,14 @@
 package gofill
 
 import (
-	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"go/types"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"unicode"
 	"unicode/utf8"
 
@@ -21,113 +23,349 @@ import (
 var Default = &Index{}
 
 type Index struct {
+	// TypeCheck enables resolving selectors with go/types.
+	// Queries fall back to syntactic resolution if the operand
+	// of a selector cannot be type checked.
+	TypeCheck bool
+
+	// mu guards pkgNames and pkgs, which overlays change.
+	mu       sync.RWMutex
 	pkgNames map[string]map[string]bool // "template" -> {"html/template", "text/template"}
 	pkgs     map[string]*pkgDecl        // "text/template" -> ...
+
+	overlayMu sync.Mutex
+	overlay   map[string]string // file path -> unsaved contents
+
+	typesMu   sync.Mutex
+	typesPkgs map[string]*typesEntry // import path -> type checked package
+
+	siblingsMu sync.Mutex
+	siblings   map[string]*siblingCache // directory -> parsed files
+
+	namesMu sync.Mutex
+	names   *nameIndex // of the keys of pkgNames, built on demand
+}
+
+// pkgNameIndex returns an index of the package names.
+func (x *Index) pkgNameIndex() *nameIndex {
+	x.namesMu.Lock()
+	defer x.namesMu.Unlock()
+	if x.names == nil {
+		var names []string
+		for name := range x.pkgNames {
+			names = append(names, name)
+		}
+		x.names = newNameIndex(names)
+	}
+	return x.names
 }
 
 func (x *Index) scopeSearch(query *queryState, n *ast.Ident) {
 	// Start by searching the scope.
-	for name := range query.scope {
-		if strings.HasPrefix(name, n.Name) {
-			if len(name) == len(n.Name) {
-				// Do not make suggestions if they have something complete.
+	for name, obj := range query.scope {
+		if name == n.Name {
+			// Do not make suggestions if they have something complete.
+			query.res.Suggest = nil
+			return
+		}
+		score, matched := match(n.Name, name)
+		if score == 0 {
+			continue
+		}
+		query.suggest(Suggestion{
+			Range:   query.pos,
+			Name:    name,
+			Kind:    kindName(obj.kind, false),
+			Type:    x.scopeObjString(query, obj),
+			Matches: matched,
+		}, score, obj.level, obj.declPos)
+	}
+
+	// Then the other files of the package.
+	if query.local != nil {
+		idx, prefixed := query.local.nameIndex().candidates(n.Name)
+		for k, i := range idx {
+			d := query.local.decls[i]
+			if _, ok := query.scope[d.name]; ok {
+				continue // shadowed
+			}
+			if d.name == n.Name {
 				query.res.Suggest = nil
 				return
 			}
-			query.res.Suggest = append(query.res.Suggest, Suggestion{
-				Range: query.pos,
-				Name:  name,
-			})
+			var score int
+			var matched []Range
+			if k < prefixed {
+				score, matched = match(n.Name, d.name)
+			} else {
+				score, matched = matchWords(n.Name, d.name)
+			}
+			if score == 0 {
+				continue
+			}
+			query.suggest(Suggestion{
+				Range:   query.pos,
+				Name:    d.name,
+				Kind:    kindName(d.kind, false),
+				Type:    d.typ,
+				Doc:     d.doc,
+				Matches: matched,
+			}, score, levelPackage, token.NoPos)
 		}
 	}
 
-	if len(query.res.Suggest) > 0 {
+	if len(query.res.Suggest) > 0 || query.mode != Active {
 		return
 	}
 
 	// If nothing in the scope matches, speculate
-	// about potential packages.
-	// TODO(crawshaw): only do this for active suggestions
-	// TODO(crawshaw): suffixarray
-	/*
-	for name := range x.pkgNames {
-		if strings.HasPrefix(name, n.Name) {
-			if len(name) == len(n.Name) {
-				query.res.Suggest = nil
-				break
+	// about potential packages. Only prefixes are
+	// considered, as short package names are easily
+	// matched by fuzzier patterns.
+	names := x.pkgNameIndex()
+	for _, i := range names.withPrefix(n.Name) {
+		name := names.names[i]
+		if !strings.HasPrefix(name, n.Name) {
+			continue
+		}
+		paths := x.pkgNames[name]
+		var importable []string
+		for path := range paths {
+			if canImport(path) {
+				importable = append(importable, path)
 			}
-			query.res.Suggest = append(query.res.Suggest, Suggestion{
-				Range: query.pos,
-				Name:  name,
-			})
+		}
+		if len(importable) == 0 {
+			continue
+		}
+		if len(name) == len(n.Name) {
+			query.res.Suggest = nil
+			return
+		}
+		s := Suggestion{
+			Range:   query.pos,
+			Name:    name,
+			Kind:    kindName(ast.Pkg, false),
+			Matches: []Range{{0, len(n.Name)}},
+		}
+		if path := x.inferImport(query, name); path != "" {
+			s.Type = strconv.Quote(path)
+			s.Edits = query.importEdits(path)
+		}
+		query.suggest(s, matchPrefix, levelImported, token.NoPos)
+	}
+}
 
+// canImport reports whether a package outside the standard
+// library may import path. Internal and vendored packages
+// are private to the trees containing them.
+func canImport(path string) bool {
+	for _, elem := range strings.Split(path, "/") {
+		if elem == "internal" || elem == "vendor" {
+			return false
 		}
 	}
-	*/
+	return true
 }
 
 func (x *Index) selectorSearch(query *queryState, primary, secondary string) {
 	// Qualified identifier (package name primary, idenitifier secondary).
 	obj, ok := query.scope[primary]
+	if d := query.localDecl(primary); !ok && d != nil {
+		switch d.kind {
+		case ast.Var, ast.Con:
+			x.memberSearch(query, x.members(query, x.declType(query, d)), secondary)
+		case ast.Typ:
+			t := typeExpr{expr: ast.NewIdent(primary), file: d.file}
+			x.memberSearch(query, x.methods(query, t, false), secondary)
+		}
+		return
+	}
 	if !ok {
-		// TODO
-		pkgs := x.pkgNames[primary]
-		if len(pkgs) == 1 {
-			// For now we do not offer any suggestions if
-			// we are unsure what the package is.
-			//
-			// TODO(crawshaw): apply the goimports logic to
-			// the file before doing this, as a prior template.HTML
-			// is enough information to safely guess which template
-			// package you want.
-			for name := range pkgs {
-				x.pkgSearch(query, x.pkgs[name], secondary)
-			}
+		// For now we do not offer any suggestions if
+		// we are unsure what the package is.
+		path := x.inferImport(query, primary)
+		if path == "" {
+			return
+		}
+		n := len(query.res.Suggest)
+		x.pkgSearch(query, x.pkgs[path], secondary)
+		edits := query.importEdits(path)
+		for i := n; i < len(query.res.Suggest); i++ {
+			query.res.Suggest[i].Edits = edits
 		}
-		// Attempt speculative package match.
-		// x.pkgSearch(query, pkg, secondary)
 		return
 	}
 	switch obj.kind {
 	case ast.Pkg:
 		x.pkgSearch(query, obj.pkg, secondary)
-	case ast.Var:
-		// TODO: Method expression
-
-		// TODO: Field selector
-	default:
-		fmt.Printf("%q is unexpected: %s\n", primary, query.scope[primary])
+	case ast.Var, ast.Con:
+		x.memberSearch(query, x.members(query, x.objType(query, obj)), secondary)
+	case ast.Typ:
+		// Method expression.
+		t := typeExpr{expr: ast.NewIdent(primary)}
+		x.memberSearch(query, x.methods(query, t, false), secondary)
+	case ast.Fun:
+		// A function value has no members.
 	}
 }
 
 func (x *Index) pkgSearch(query *queryState, pkg *pkgDecl, name string) {
-	for _, decl := range pkg.decls {
+	// Every kind of match begins with the first rune, but only
+	// the names beginning with the whole name match as prefixes.
+	idx, prefixed := pkg.nameIndex().candidates(name)
+	for k, i := range idx {
+		decl := pkg.decls[i]
 		if !ast.IsExported(decl.name) {
 			continue
 		}
-		if strings.HasPrefix(decl.name, name) {
-			if len(name) == len(decl.name) {
-				query.res.Suggest = nil
-				return
-			}
-			query.res.Suggest = append(query.res.Suggest, Suggestion{
-				Range: query.pos,
-				Name:  decl.name,
-				Doc:   decl.doc,
-			})
+		if decl.name == name {
+			query.res.Suggest = nil
+			return
+		}
+		var score int
+		var matched []Range
+		if k < prefixed {
+			score, matched = match(name, decl.name)
+		} else {
+			score, matched = matchWords(name, decl.name)
+		}
+		if score == 0 {
+			continue
 		}
+		query.suggest(Suggestion{
+			Range:   query.pos,
+			Name:    decl.name,
+			Kind:    kindName(decl.kind, false),
+			Type:    decl.typ,
+			Doc:     decl.doc,
+			Matches: matched,
+		}, score, levelImported, token.NoPos)
+	}
+}
+
+func (x *Index) memberSearch(query *queryState, members []*decl, name string) {
+	for _, f := range members {
+		if f.name == name {
+			query.res.Suggest = nil
+			return
+		}
+		score, matched := match(name, f.name)
+		if score == 0 {
+			continue
+		}
+		level := levelImported
+		if f.file == nil || f.file.pkg == query.local {
+			level = levelPackage
+		}
+		query.suggest(Suggestion{
+			Range:   query.pos,
+			Name:    f.name,
+			Kind:    kindName(f.kind, true),
+			Type:    f.typ,
+			Doc:     f.doc,
+			Matches: matched,
+		}, score, level, token.NoPos)
 	}
 }
 
 type queryState struct {
-	f     *ast.File
-	path  []ast.Node
-	scope map[string]scopeObj
-	pos   Range
-	res   Result
+	mode   Mode
+	src    string // as given to Query
+	offset int    // of the cursor in src
+	fake   bool   // an identifier was inserted at offset
+	cursor token.Pos
+	fset   *token.FileSet
+	f      *ast.File
+	path   []ast.Node
+	scope  map[string]scopeObj
+	pos    Range // the identifier being completed
+	res    Result
+	depth  int // of exprType recursion
+
+	wantType bool // the cursor is where a type is expected
+
+	inferred map[string]string // unimported package name -> import path
+
+	siblings []*ast.File // the other files of the package
+	local    *pkgDecl    // declarations in siblings, or nil
+
+	// Set when type checking.
+	info *types.Info
+	pkg  *types.Package
+}
+
+// Mode selects how eagerly Query suggests completions.
+type Mode int
+
+const (
+	// Passive completion runs as the user types, and only
+	// suggests names that are already in scope.
+	Passive Mode = iota
+
+	// Active completion is explicitly requested by the user,
+	// and may also suggest packages that are not yet imported.
+	Active
+)
+
+// Query makes suggestions for the source src of a file, with
+// the cursor at offset. If filename is not empty, it is the path
+// of the file, and the other files of its package are read from
+// the same directory.
+func (x *Index) Query(filename, src string, offset int, mode Mode) Result {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	query := x.newQuery(filename, src, offset, mode)
+	path := query.path
+	if len(path) <= 2 {
+		// We do nothing useful at the top level yet (maybe never).
+		//
+		// In particular, ignore top-level Idents. In the top-level,
+		// suggesting from the scope doesn't make sense.
+		return query.res
+	}
+
+	if x.TypeCheck {
+		x.typeCheck(query)
+	}
+	x.signatureHelp(query)
+
+	if n, ok := path[1].(*ast.SelectorExpr); ok {
+		query.pos = query.rangeOf(n.Sel)
+		var secondary string
+		if !query.fake {
+			secondary = n.Sel.Name
+		}
+		if x.typedSelectorSearch(query, n, secondary) {
+			// Resolved with go/types.
+		} else if id, ok := n.X.(*ast.Ident); ok {
+			x.selectorSearch(query, id.Name, secondary)
+		} else if t, ok := x.typeOperand(query, n.X); ok {
+			// Method expression, e.g. (*bytes.Buffer).Write.
+			x.memberSearch(query, x.methods(query, t, false), secondary)
+		} else {
+			t := x.exprType(query, n.X, nil)
+			x.memberSearch(query, x.members(query, t), secondary)
+		}
+	} else if n, ok := path[0].(*ast.Ident); ok {
+		query.pos = query.rangeOf(n)
+		x.scopeSearch(query, n)
+	}
+
+	// Suggestions stop once the identifier is complete, and
+	// only then is it worth finding the others like it.
+	if !query.fake && len(query.res.Suggest) == 0 {
+		x.related(query)
+	}
+
+	sort.Sort(byScore(query.res.Suggest))
+	return query.res
 }
 
-func (x *Index) Query(src string, offset int) Result {
+// newQuery parses src and finds the path to the cursor at offset.
+// Parse errors are reported in the result. If src has no package
+// clause, the path is empty.
+func (x *Index) newQuery(filename, src string, offset int, mode Mode) *queryState {
 	// We begin with a deeply offensive hack.
 	// When faced with a syntactically correct selector,
 	// e.g. fmt.P, the parser generates:
@@ -162,11 +400,11 @@ func (x *Index) Query(src string, offset int) Result {
 	// So we cheat. If the caret offset is placed directly
 	// after a selector, and the following rune is not a
 	// valid initial identifier rune, we insert one.
+	orig := src
 	var fakeIdentifier bool
 	if offset > 0 {
 		sel, _ := utf8.DecodeLastRuneInString(src[:offset])
 		identStart, _ := utf8.DecodeRuneInString(src[offset:])
-		fmt.Printf("sel=%c, identStart=%c\n", sel, identStart)
 		if sel == '.' && !unicode.IsLetter(identStart) {
 			src = src[:offset] + "X" + src[offset:]
 			fakeIdentifier = true
@@ -174,11 +412,21 @@ func (x *Index) Query(src string, offset int) Result {
 	}
 
 	fset := token.NewFileSet()
+	var siblings []*ast.File
+	if filename != "" {
+		siblings = x.addSiblings(fset, filename)
+	}
 	f, err := parser.ParseFile(fset, "file.go", src, parser.ParseComments|parser.AllErrors)
-	ast.Print(fset, f)
 
-	pos := f.Package + token.Pos(offset)
-	end := pos
+	tf := fset.File(f.Package)
+	if tf == nil {
+		// Not even a package clause.
+		query := &queryState{src: orig, offset: offset, fake: fakeIdentifier}
+		query.parseErrors(err)
+		return query
+	}
+	cursor := tf.Pos(offset)
+	pos, end := cursor, cursor
 	// Step back one when searching for the enclosing expression as
 	// we typically complete partially typed words.
 	if offset > 0 {
@@ -188,85 +436,169 @@ func (x *Index) Query(src string, offset int) Result {
 		end++
 	}
 	path, _ := astutil.PathEnclosingInterval(f, pos, end)
-	fmt.Printf("PathEnclosingInterval(%d, %d): %#+v\n", pos, end, path)
 
 	query := &queryState{
-		f:     f,
-		path:  path,
-		scope: scope(x.pkgs, path),
-		pos:   Range{}, // TODO path[0] Pos
-		res:   Result{},
+		mode:     mode,
+		src:      orig,
+		offset:   offset,
+		fake:     fakeIdentifier,
+		cursor:   cursor,
+		fset:     fset,
+		f:        f,
+		path:     path,
+		scope:    scope(x.pkgs, path),
+		wantType: wantType(path),
+		res:      Result{},
 	}
 
 	if err != nil {
-		query.res.Error = append(query.res.Error, Error{
-			Range: Range{-1, -1}, // TODO
-			Error: err.Error(),   // TODO split out all the errors
-		})
+		query.parseErrors(err)
 	}
-
-	if len(path) <= 2 {
-		// We do nothing useful at the top level yet (maybe never).
-		//
-		// In particular, ignore top-level Idents. In the top-level,
-		// suggesting from the scope doesn't make sense.
-		return query.res
-	}
-
-	if n, ok := path[1].(*ast.SelectorExpr); ok {
-		// TODO(crawshaw): do something sensible with `x.y.‸`
-		var primary, secondary string
-		if n, ok := n.X.(*ast.Ident); ok {
-			primary = n.Name
-		}
-		if !fakeIdentifier {
-			secondary = n.Sel.Name
-		}
-		x.selectorSearch(query, primary, secondary)
-	} else if n, ok := path[0].(*ast.Ident); ok {
-		x.scopeSearch(query, n)
+	if filename != "" {
+		x.loadSiblings(query, filename, siblings)
 	}
-
-	sort.Sort(byName(query.res.Suggest))
-	return query.res
+	return query
 }
 
-type byName []Suggestion
-
-func (s byName) Len() int           { return len(s) }
-func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
-func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
-
 type Range struct {
-	Pos int // relative to offset
-	End int // relative to offset
+	Pos int // byte offset in the source
+	End int // byte offset in the source
 }
 
 type Error struct {
-	Range Range
-	Error string
+	Range    Range
+	Line     int    // 1-based
+	Column   int    // 1-based, in bytes
+	Severity string // SeverityError
+	Error    string
 }
 
 type Suggestion struct {
 	Range Range
 	Name  string
-	// TODO Kind  string
-	Doc string `json:",omitempty"`
+	Kind  string // func, method, var, const, type, field or package
+	Type  string `json:",omitempty"` // e.g. "func(s string) string"
+	Doc   string `json:",omitempty"`
+
+	// Matches are the ranges of Name matching what has been
+	// typed, relative to the start of Name, for highlighting.
+	Matches []Range `json:",omitempty"`
+
+	// Edits are additional changes to make when the
+	// suggestion is accepted, such as adding an import.
+	Edits []Edit `json:",omitempty"`
+
+	// Score orders suggestions, best first. Scores are
+	// comparable between the results of a single query.
+	Score int
+}
+
+// kindName names an object kind for Suggestion.Kind.
+// Members of a type are fields and methods, not vars and funcs.
+func kindName(kind ast.ObjKind, member bool) string {
+	switch kind {
+	case ast.Pkg:
+		return "package"
+	case ast.Con:
+		return "const"
+	case ast.Typ:
+		return "type"
+	case ast.Var:
+		if member {
+			return "field"
+		}
+		return "var"
+	case ast.Fun:
+		if member {
+			return "method"
+		}
+		return "func"
+	}
+	return ""
 }
 
 type Result struct {
-	Suggest []Suggestion `json:",omitempty"`
-	Related []Range      `json:",omitempty"`
-	Error   []Error      `json:",omitempty"`
+	Suggest   []Suggestion `json:",omitempty"`
+	Signature *Signature   `json:",omitempty"`
+	Related   []Range      `json:",omitempty"`
+	Error     []Error      `json:",omitempty"`
 }
 
 type pkgDecl struct {
+	path      string
+	dir       string // if known
 	shortName string
-	decls     []*decl // TODO(crawshaw): suffixarray?
+	doc       string
+	decls     []*decl
+	methods   map[string][]*decl // receiver type name -> methods
+
+	mu    sync.Mutex
+	names *nameIndex // of decls, built on demand
 }
 
 type decl struct {
 	name string
-	typ  string // TODO
+	pos  token.Pos // of the name, in file.fset
+	kind ast.ObjKind
+	typ  string // rendered by declString
 	doc  string
+	expr ast.Expr  // type of a var or const, underlying type of a type
+	val  ast.Expr  // value of a var or const without an explicit type
+	file *fileInfo // nil for declarations in the queried file
+
+	ptrRecv bool // method with a pointer receiver
+}
+
+// fileInfo is the context needed to resolve identifiers
+// appearing in the declarations of an indexed file.
+type fileInfo struct {
+	pkg     *pkgDecl
+	imports []fileImport
+	fset    *token.FileSet // nil if positions are unknown
+}
+
+type fileImport struct {
+	name string // explicit name, or ""
+	path string
+}
+
+// declString renders the type of a var, const or field, the
+// signature of a func, or a short description of a type.
+func declString(kind ast.ObjKind, name string, expr ast.Expr) string {
+	if expr == nil {
+		return ""
+	}
+	if kind != ast.Typ {
+		return types.ExprString(expr)
+	}
+	switch expr.(type) {
+	case *ast.StructType:
+		return "type " + name + " struct"
+	case *ast.InterfaceType:
+		return "type " + name + " interface"
+	}
+	return "type " + name + " " + types.ExprString(expr)
+}
+
+// nameIndex returns an index of the names of pkg.decls.
+func (pkg *pkgDecl) nameIndex() *nameIndex {
+	pkg.mu.Lock()
+	defer pkg.mu.Unlock()
+	if pkg.names == nil {
+		names := make([]string, len(pkg.decls))
+		for i, d := range pkg.decls {
+			names[i] = d.name
+		}
+		pkg.names = newNameIndex(names)
+	}
+	return pkg.names
+}
+
+func (pkg *pkgDecl) lookup(name string) *decl {
+	for _, i := range pkg.nameIndex().withPrefix(name) {
+		if d := pkg.decls[i]; d.name == name {
+			return d
+		}
+	}
+	return nil
 }
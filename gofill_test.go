@@ -5,9 +5,18 @@
 package gofill
 
 import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 )
 
 const fmtDoc = "Package fmt implements formatted I/O with functions analogous to C's printf and scanf. The format 'verbs' are derived from C's but are simpler."
@@ -40,7 +49,7 @@ var suggestTests = []suggestTest{
 		}
 		`,
 		// no fmt nor flag
-		[]string{"frenchToast", "friedBread", "friedEggs", "fritters"},
+		[]string{"friedBread", "frenchToast", "friedEggs", "fritters"},
 		nil,
 	},
 	{
@@ -71,7 +80,7 @@ var suggestTests = []suggestTest{
 			}
 		}
 		`,
-		[]string{"fmt", "fn"},
+		[]string{"fn", "fmt"},
 		nil,
 	},
 	{
@@ -144,6 +153,292 @@ var suggestTests = []suggestTest{
 		[]string{"value"},
 		nil,
 	},
+	{
+		"range key and value",
+		`package main
+
+		type point struct{ x, y int }
+
+		func main() {
+			var byName map[string]*point
+			for name, pt := range byName {
+				pt.‸
+			}
+		}
+		`,
+		[]string{"x", "y"},
+		nil,
+	},
+	{
+		"range over a slice",
+		`package main
+
+		type point struct{ x, y int }
+
+		func main() {
+			pts := []point{}
+			for index, pt := range pts {
+				if in‸
+			}
+		}
+		`,
+		[]string{"index"},
+		nil,
+	},
+	{
+		"for init",
+		`package main
+
+		func main() {
+			for count := 0; co‸ < 10; count++ {
+			}
+		}
+		`,
+		[]string{"count"},
+		nil,
+	},
+	{
+		"select receive",
+		`package main
+
+		type point struct{ x, y int }
+
+		func main() {
+			points := make(chan point)
+			select {
+			case pt, ok := <-points:
+				pt.‸
+			}
+		}
+		`,
+		[]string{"x", "y"},
+		nil,
+	},
+	{
+		"type switch clause",
+		`package main
+
+		type point struct{ x, y int }
+
+		func describe(v interface{}) {
+			switch v := v.(type) {
+			case point:
+				v.‸
+			}
+		}
+		`,
+		[]string{"x", "y"},
+		nil,
+	},
+	{
+		"type switch clause with several types",
+		`package main
+
+		type point struct{ x, y int }
+
+		func describe(v interface{}) {
+			switch v := v.(type) {
+			case point, *point:
+				v.‸
+			}
+		}
+		`,
+		nil,
+		nil,
+	},
+	{
+		"case clause body",
+		`package main
+
+		func main() {
+			switch {
+			case true:
+				total := 0
+				if to‸
+			}
+		}
+		`,
+		[]string{"total"},
+		nil,
+	},
+	{
+		"params and named results",
+		`package main
+
+		func handle(req, resp int) (result int, err error) {
+			re‸
+		}
+		`,
+		[]string{"req", "resp", "result"},
+		nil,
+	},
+	{
+		"receiver",
+		`package main
+
+		type server struct{ name string }
+
+		func (srv *server) handle() {
+			s‸
+		}
+		`,
+		[]string{"srv", "server"},
+		nil,
+	},
+	{
+		"closure params and enclosing params",
+		`package main
+
+		func scaled(scale int) func(int) int {
+			return func(n int) (sum int) {
+				s‸
+			}
+		}
+		`,
+		[]string{"sum", "scale", "scaled"},
+		nil,
+	},
+	{
+		"type parameters",
+		`package main
+
+		func Keys[Key comparable, Val any](m map[Key]Val) []Key {
+			var v K‸
+		}
+		`,
+		[]string{"Key", "Keys"},
+		nil,
+	},
+	{
+		"receiver type parameters",
+		`package main
+
+		type List[Elem any] struct{ items []Elem }
+
+		func (l *List[Elem]) Push(e Elem) {
+			var last El‸
+		}
+		`,
+		[]string{"Elem"},
+		nil,
+	},
+
+	{
+		"functions in the file",
+		`package main
+
+		func main() {
+			hel‸
+		}
+
+		func helper(n int) string { return "" }
+
+		func init() {}
+		`,
+		[]string{"helper"},
+		nil,
+	},
+	{
+		"result of a function in the file",
+		`package main
+
+		type point struct{ x, y int }
+
+		func origin() *point { return &point{} }
+
+		func main() {
+			origin().‸
+		}
+		`,
+		[]string{"x", "y"},
+		nil,
+	},
+	{
+		"methods of a type in the file",
+		`package main
+
+		type server struct{ name string }
+
+		func (srv *server) handle() {
+			srv.‸
+		}
+
+		func (srv server) String() string { return srv.name }
+		`,
+		[]string{"String", "handle", "name"},
+		nil,
+	},
+
+	// Declare before use, and shadowing.
+	{
+		"later declarations are not in scope",
+		`package main
+
+		func main() {
+			before := 1
+			be‸
+			behind := 2
+		}
+		`,
+		[]string{"before"},
+		nil,
+	},
+	{
+		"package declarations in any order",
+		`package main
+
+		func main() {
+			lat‸
+		}
+
+		var later int
+		`,
+		[]string{"later"},
+		nil,
+	},
+	{
+		"not in scope in its own declaration",
+		`package main
+
+		func main() {
+			tally := tal‸
+		}
+		`,
+		nil,
+		nil,
+	},
+	{
+		"shadowing, as in x := x.next",
+		`package main
+
+		type node struct {
+			next *node
+			val  int
+		}
+
+		func main() {
+			n := &node{}
+			for n != nil {
+				n := n.next
+				n.‸
+			}
+		}
+		`,
+		[]string{"next", "val"},
+		nil,
+	},
+	{
+		"if init is not in scope in its own init",
+		`package main
+
+		func main() {
+			if value := val‸; value > 0 {
+			}
+		}
+		`,
+		nil,
+		nil,
+	},
 
 	// Resilience to badly formed code
 	{
@@ -162,19 +457,19 @@ var suggestTests = []suggestTest{
 		"empty scope, multiple matching packages, avoid large repo overload",
 		`package main
 
-		func main() { fi‸ }
+		func main() { fakef‸ }
 		`,
 		nil,
-		[]string{"file", "filepath"},
+		[]string{"fakefile", "fakefilepath"},
 	},
 	{
 		"package in expr",
 		`package main
 
-		func main() { _, err := fi‸ }
+		func main() { _, err := fakef‸ }
 		`,
 		nil,
-		[]string{"file", "filepath"},
+		[]string{"fakefile", "fakefilepath"},
 	},
 	{
 		"one matching inferred package, suggest",
@@ -209,9 +504,9 @@ var suggestTests = []suggestTest{
 		"BadExpr",
 		`package main
 
-		func main() { fmt.‸ }
+		func main() { fakeprint.‸ }
 		`,
-		[]string{"Errorf", "Formatter", "Fprint", "Fprintf", "Fprintln", "Fscan", "Fscanf", "Fscanln", "GoStringer", "Print", "Printf", "Println", "Scan", "ScanState", "Scanf", "Scanln", "Scanner", "Sprint", "Sprintf", "Sprintln", "Sscan", "Sscanf", "Sscanln", "State", "Stringer"},
+		[]string{"Errorf", "Fprint", "Print", "Printf", "Println", "Stringer"},
 		nil,
 	},
 	{
@@ -237,44 +532,2229 @@ var suggestTests = []suggestTest{
 		nil,
 	},
 
-	/*
-		{
-			"goimports inference of ambiguous package",
-			`package main
+	// Fields of variables
+	{
+		"fields of a local struct",
+		`package main
 
-			func main() {
-				var x template.HTML // narrows down to "html/template"
-				template.C‸
-			}`,
-			[]string{"CSS"},
-			nil,
-		},
-	*/
-}
+		type point struct {
+			X, Y  int
+			label string
+		}
 
-func TestSuggest(t *testing.T) {
-	for _, test := range suggestTests {
-		offset := strings.IndexRune(test.src, '‸')
-		if offset < 0 {
-			t.Fatalf("%q: no '‸'", test.name)
+		func main() {
+			var p point
+			p.‸
 		}
-		src := test.src[:offset] + test.src[offset+len("‸"):]
-		res := index.Query(src, offset)
-		var got []string
-		for _, s := range res.Suggest {
-			got = append(got, s.Name)
+		`,
+		[]string{"X", "Y", "label"},
+		nil,
+	},
+	{
+		"fields of a pointer from a composite literal",
+		`package main
+
+		type point struct {
+			X, Y  int
+			label string
 		}
-		if !reflect.DeepEqual(got, test.passive) {
-			t.Errorf("%q passive:\ngot  %v\nwant %v", test.name, got, test.passive)
+
+		func main() {
+			p := &point{}
+			p.la‸
 		}
-	}
-}
+		`,
+		[]string{"label"},
+		nil,
+	},
+	{
+		"promoted fields of an embedded struct",
+		`package main
 
-var index *Index
+		type base struct{ ID int }
+		type item struct {
+			base
+			Name string
+		}
 
-func init() {
-	index = SimpleIndexer()
-	index.pkgs["fake/go-fakepkg"] = &pkgDecl{
-		shortName: "fakepkg",
-	}
-}
+		func main() {
+			it := item{}
+			it.‸
+		}
+		`,
+		[]string{"ID", "Name", "base"},
+		nil,
+	},
+	{
+		"fields of a package type parameter",
+		`package main
+
+		import "net/http"
+
+		func handle(w http.ResponseWriter, r *http.Request) {
+			r.Hea‸
+		}
+		`,
+		[]string{"Header"},
+		nil,
+	},
+	{
+		"fields of a package composite literal",
+		`package main
+
+		import "net/url"
+
+		func main() {
+			u := url.URL{}
+			u.Ho‸
+		}
+		`,
+		[]string{"Host", "Hostname"},
+		nil,
+	},
+	{
+		"unexported fields of package types are hidden",
+		`package main
+
+		import "net/http"
+
+		func main() {
+			var req http.Request
+			req.ct‸
+		}
+		`,
+		[]string{"ContentLength", "Context"},
+		nil,
+	},
+
+	// Methods
+	{
+		"methods of a package type",
+		`package main
+
+		import "bytes"
+
+		func main() {
+			var buf bytes.Buffer
+			buf.WriteS‸
+		}
+		`,
+		[]string{"WriteString"},
+		nil,
+	},
+	{
+		"fields and methods together",
+		`package main
+
+		import "net/http"
+
+		func handle(r *http.Request) {
+			r.Cont‸
+		}
+		`,
+		[]string{"ContentLength", "Context"},
+		nil,
+	},
+	{
+		"methods promoted from an embedded type",
+		`package main
+
+		import "sync"
+
+		type counter struct {
+			sync.Mutex
+			n int
+		}
+
+		func main() {
+			var c counter
+			c.Lo‸
+		}
+		`,
+		[]string{"Lock"},
+		nil,
+	},
+	{
+		"interface methods",
+		`package main
+
+		import "io"
+
+		func main() {
+			var w io.Writer
+			w.‸
+		}
+		`,
+		[]string{"Write"},
+		nil,
+	},
+	{
+		"pointer method expression",
+		`package main
+
+		import "bytes"
+
+		func main() {
+			(*bytes.Buffer).WriteS‸
+		}
+		`,
+		[]string{"WriteString"},
+		nil,
+	},
+	{
+		"value method expression excludes pointer methods",
+		`package main
+
+		import "bytes"
+
+		func main() {
+			bytes.Buffer.WriteS‸
+		}
+		`,
+		nil,
+		nil,
+	},
+	{
+		"value method expression",
+		`package main
+
+		import "time"
+
+		func main() {
+			time.Time.Befo‸
+		}
+		`,
+		[]string{"Before"},
+		nil,
+	},
+
+	// Selector chains
+	{
+		"package variable field",
+		`package main
+
+		import "net/http"
+
+		func main() { http.DefaultClient.Tr‸ }
+		`,
+		[]string{"Transport"},
+		nil,
+	},
+	{
+		"nested struct fields",
+		`package main
+
+		type timeouts struct{ Read, Write int }
+		type config struct {
+			Timeouts timeouts
+			Name     string
+		}
+		type server struct{ cfg *config }
+
+		func run(s *server) {
+			s.cfg.Timeouts.Re‸
+		}
+		`,
+		[]string{"Read"},
+		nil,
+	},
+	{
+		"function results",
+		`package main
+
+		import "net/http"
+
+		func main() {
+			req, err := http.NewRequest("GET", "/", nil)
+			req.URL.Ho‸
+		}
+		`,
+		[]string{"Host", "Hostname"},
+		nil,
+	},
+	{
+		"method results",
+		`package main
+
+		import "strings"
+
+		func main() {
+			strings.NewReplacer("a", "b").Repl‸
+		}
+		`,
+		[]string{"Replace"},
+		nil,
+	},
+	{
+		"slice elements",
+		`package main
+
+		type item struct{ Name string }
+
+		func main() {
+			items := make([]*item, 3)
+			items[0].N‸
+		}
+		`,
+		[]string{"Name"},
+		nil,
+	},
+
+	// Inferring unimported packages
+	{
+		"goimports inference of ambiguous package",
+		`package main
+
+		func main() {
+			var x template.HTML // narrows down to "html/template"
+			template.C‸
+		}`,
+		[]string{"CSS"},
+		nil,
+	},
+	{
+		"ambiguous package without evidence",
+		`package main
+
+		func main() {
+			template.C‸
+		}`,
+		nil,
+		nil,
+	},
+	{
+		"usage rules out candidates",
+		`package main
+
+		func main() {
+			n := rand.Intn(10) // not crypto/rand
+			rand.See‸
+		}`,
+		[]string{"Seed"},
+		nil,
+	},
+
+	// Fuzzy matching
+	{
+		"camelCase initials",
+		`package main
+
+		import "net/http"
+
+		func main() {
+			http.LAS‸
+		}`,
+		[]string{"ListenAndServe", "ListenAndServeTLS"},
+		nil,
+	},
+	{
+		"subsequence",
+		`package main
+
+		import "fmt"
+
+		func main() {
+			fmt.pf‸
+		}`,
+		[]string{"Printf"},
+		nil,
+	},
+	{
+		"exact prefixes rank first",
+		`package main
+
+		func main() {
+			var pageRank, parser, prev, Prefix int
+			pr‸
+		}`,
+		[]string{"prev", "Prefix", "pageRank", "parser"},
+		nil,
+	},
+
+	// Ranking
+	{
+		"locals before params before package names before imports",
+		`package main
+
+		import "regexp"
+
+		var remote int
+
+		func main(retries int) {
+			var result int
+			re‸
+		}`,
+		[]string{"result", "retries", "remote", "regexp"},
+		nil,
+	},
+	{
+		"types where a type is expected",
+		`package main
+
+		type record struct{}
+
+		func main() {
+			rec := 1
+			var r re‸
+		}`,
+		[]string{"record", "rec"},
+		nil,
+	},
+	{
+		"nearer declarations first",
+		`package main
+
+		func main() {
+			rowsCount := 0
+			rowsTotal := 0
+			rows‸
+		}`,
+		[]string{"rowsTotal", "rowsCount"},
+		nil,
+	},
+	{
+		"no members of a function",
+		`package main
+
+		func helper() {}
+
+		func main() {
+			helper.‸
+		}`,
+		nil,
+		nil,
+	},
+}
+
+func TestSuggest(t *testing.T) {
+	testSuggest(t, index, suggestTests)
+}
+
+var typeCheckTests = []suggestTest{
+	{
+		"package variable",
+		`package main
+
+		import "os"
+
+		func main() { os.Stdout.WriteS‸ }
+		`,
+		[]string{"WriteString"},
+		nil,
+	},
+	{
+		"function result",
+		`package main
+
+		import "strings"
+
+		func main() {
+			s := "hello"
+			strings.NewReader(s).ReadR‸
+		}
+		`,
+		[]string{"ReadRune"},
+		nil,
+	},
+	{
+		"map element",
+		`package main
+
+		import "net/url"
+
+		func main() {
+			m := map[string]*url.URL{}
+			m["k"].F‸
+		}
+		`,
+		[]string{"ForceQuery", "Fragment"},
+		nil,
+	},
+	{
+		"local types and unexported fields",
+		`package main
+
+		type T struct{ name string }
+
+		func (t T) nickname() string { return t.name }
+
+		func main() {
+			[]T{}[0].n‸
+		}
+		`,
+		[]string{"name", "nickname"},
+		nil,
+	},
+}
+
+func TestTypeCheckSuggest(t *testing.T) {
+	typed := typedIndex()
+	testSuggest(t, typed, typeCheckTests)
+	testSuggest(t, typed, suggestTests)
+}
+
+// typedIndex returns the test index, resolving selectors
+// with go/types.
+func typedIndex() *Index {
+	return &Index{
+		TypeCheck: true,
+		pkgNames:  index.pkgNames,
+		pkgs:      index.pkgs,
+	}
+}
+
+// cursor removes the '‸' marking the cursor from src, returning
+// the source and the offset of the cursor.
+func cursor(t *testing.T, src string) (string, int) {
+	offset := strings.IndexRune(src, '‸')
+	if offset < 0 {
+		t.Fatalf("no '‸' in %q", src)
+	}
+	return src[:offset] + src[offset+len("‸"):], offset
+}
+
+func testSuggest(t *testing.T, x *Index, tests []suggestTest) {
+	for _, test := range tests {
+		src, offset := cursor(t, test.src)
+		res := x.Query("", src, offset, Passive)
+		var got []string
+		for _, s := range res.Suggest {
+			got = append(got, s.Name)
+		}
+		if !reflect.DeepEqual(got, test.passive) {
+			t.Errorf("%q passive:\ngot  %v\nwant %v", test.name, got, test.passive)
+		}
+
+		var want []string
+		want = append(want, test.passive...)
+		want = append(want, test.active...)
+		sort.Strings(want)
+		res = x.Query("", src, offset, Active)
+		got = nil
+		for _, s := range res.Suggest {
+			got = append(got, s.Name)
+		}
+		sort.Strings(got) // passive covers the order
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q active:\ngot  %v\nwant %v", test.name, got, want)
+		}
+	}
+}
+
+var matchTests = []struct {
+	pattern, name string
+	score         int
+	matched       []Range
+}{
+	{"", "Print", matchPrefix, nil},
+	{"Pri", "Print", matchPrefix, []Range{{0, 3}}},
+	{"pri", "Print", matchFoldPrefix, []Range{{0, 3}}},
+	{"LAS", "ListenAndServe", matchInitials, []Range{{0, 1}, {6, 7}, {9, 10}}},
+	{"las", "ListenAndServe", matchInitials, []Range{{0, 1}, {6, 7}, {9, 10}}},
+	{"ListAS", "ListenAndServe", matchInitials, []Range{{0, 4}, {6, 7}, {9, 10}}},
+	{"lisTLS", "ListenAndServeTLS", matchInitials, []Range{{0, 3}, {14, 17}}},
+	{"nr", "NewHTTPRequest", matchInitials, []Range{{0, 1}, {7, 8}}},
+	{"ht", "NewHTTPRequest", 0, nil},
+	{"rUrl", "raw_url", matchInitials, []Range{{0, 1}, {4, 7}}},
+	{"pf", "Printf", matchSubsequence, []Range{{0, 1}, {5, 6}}},
+	{"prnf", "Printf", matchSubsequence, []Range{{0, 2}, {3, 4}, {5, 6}}},
+	{"pf", "Sprintf", 0, nil},
+	{"Printf", "Print", 0, nil},
+}
+
+func TestMatch(t *testing.T) {
+	for _, test := range matchTests {
+		score, matched := match(test.pattern, test.name)
+		if score != test.score || !reflect.DeepEqual(matched, test.matched) {
+			t.Errorf("match(%q, %q) = %d, %v, want %d, %v", test.pattern, test.name, score, matched, test.score, test.matched)
+		}
+	}
+}
+
+var kindTests = []struct {
+	src       string
+	name      string
+	kind, typ string
+}{
+	{
+		`package main
+
+		import "strings"
+
+		func main() { strings.TrimS‸ }`,
+		"TrimSpace", "func", "func(s string) string",
+	},
+	{
+		`package main
+
+		import "bytes"
+
+		func main() { bytes.Buf‸ }`,
+		"Buffer", "type", "type Buffer struct",
+	},
+	{
+		`package main
+
+		import "time"
+
+		func main() { time.Nanos‸ }`,
+		"Nanosecond", "const", "Duration",
+	},
+	{
+		`package main
+
+		import "bytes"
+
+		func main() {
+			var buf bytes.Buffer
+			buf.WriteS‸
+		}`,
+		"WriteString", "method", "func(s string) (n int, err error)",
+	},
+	{
+		`package main
+
+		type point struct{ X, Y int }
+
+		func main() {
+			p := point{}
+			p.‸
+		}`,
+		"X", "field", "int",
+	},
+	{
+		`package main
+
+		type point struct{ X, Y int }
+
+		func main() {
+			pt := &point{}
+			p‸
+		}`,
+		"pt", "var", "*point",
+	},
+	{
+		`package main
+
+		const maxRetries = 3
+
+		func main() { maxR‸ }`,
+		"maxRetries", "const", "int",
+	},
+	{
+		`package main
+
+		func main() {
+			const limit = 3
+			lim‸
+		}`,
+		"limit", "const", "int",
+	},
+	{
+		`package main
+
+		import "net/http"
+
+		func main() { h‸ }`,
+		"http", "package", `"net/http"`,
+	},
+}
+
+func TestSuggestKind(t *testing.T) {
+	for _, test := range kindTests {
+		src, offset := cursor(t, test.src)
+		res := index.Query("", src, offset, Passive)
+		found := false
+		for _, s := range res.Suggest {
+			if s.Name != test.name {
+				continue
+			}
+			found = true
+			if s.Kind != test.kind || s.Type != test.typ {
+				t.Errorf("%s: got kind %q type %q, want %q %q", test.name, s.Kind, s.Type, test.kind, test.typ)
+			}
+		}
+		if !found {
+			t.Errorf("%s: not suggested", test.name)
+		}
+	}
+}
+
+var signatureTests = []struct {
+	src    string
+	name   string
+	params []string
+	active int
+	doc    string // prefix, with newlines as spaces
+}{
+	{
+		`package main
+
+		import "strings"
+
+		func main() { strings.Repeat("ab", ‸) }`,
+		"Repeat", []string{"s string", "count int"}, 1,
+		"Repeat returns a new string consisting of count copies",
+	},
+	{
+		`package main
+
+		import "strings"
+
+		func main() { strings.Repeat(‸) }`,
+		"Repeat", []string{"s string", "count int"}, 0,
+		"Repeat returns a new string consisting of count copies",
+	},
+	{
+		`package main
+
+		// add returns the sum of a and b.
+		func add(a, b int) int { return a + b }
+
+		func main() { add(1, 2‸) }`,
+		"add", []string{"a int", "b int"}, 1,
+		"add returns the sum of a and b.",
+	},
+	{
+		`package main
+
+		import "bytes"
+
+		func main() {
+			var buf bytes.Buffer
+			buf.WriteString(‸)
+		}`,
+		"WriteString", []string{"s string"}, 0,
+		"WriteString appends the contents of s to the buffer",
+	},
+	{
+		`package main
+
+		import "strings"
+
+		func main() { strings.Repeat(strings.ToUpper(‸), 2) }`,
+		"ToUpper", []string{"s string"}, 0,
+		"ToUpper returns s with all Unicode letters mapped to their upper case.",
+	},
+	{
+		`package main
+
+		import "fmt"
+
+		func main() { fmt.Println(1, 2, ‸) }`,
+		"Println", nil, 0,
+		"Println formats using the default formats",
+	},
+}
+
+func TestSignature(t *testing.T) {
+	typed := typedIndex()
+	for _, x := range []*Index{index, typed} {
+		for _, test := range signatureTests {
+			src, offset := cursor(t, test.src)
+			sig := x.Query("", src, offset, Passive).Signature
+			if sig == nil {
+				t.Errorf("%s (typecheck=%v): no signature", test.name, x.TypeCheck)
+				continue
+			}
+			if sig.Name != test.name || sig.Active != test.active {
+				t.Errorf("%s (typecheck=%v): got %s active %d, want active %d", test.name, x.TypeCheck, sig.Name, sig.Active, test.active)
+			}
+			if test.params != nil && !reflect.DeepEqual(sig.Params, test.params) {
+				t.Errorf("%s (typecheck=%v): got params %q, want %q", test.name, x.TypeCheck, sig.Params, test.params)
+			}
+			if doc := strings.Replace(sig.Doc, "\n", " ", -1); !strings.HasPrefix(doc, test.doc) {
+				t.Errorf("%s (typecheck=%v): got doc %q, want %q", test.name, x.TypeCheck, sig.Doc, test.doc)
+			}
+		}
+	}
+}
+
+var importTests = []struct {
+	name string
+	src  string
+	want string // src after applying the edits of the suggestion
+}{
+	{
+		"TrimSpace",
+		`package main
+
+func main() { strings.TrimS‸ }
+`,
+		`package main
+
+import "strings"
+
+func main() { strings.TrimS }
+`,
+	},
+	{
+		"TrimSpace",
+		`package main
+
+import "fmt"
+
+func main() { strings.TrimS‸ }
+`,
+		`package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func main() { strings.TrimS }
+`,
+	},
+	{
+		"TrimSpace",
+		`package main
+
+import (
+	"fmt"
+	"unicode"
+
+	"example.com/other"
+)
+
+func main() { strings.TrimS‸ }
+`,
+		`package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"example.com/other"
+)
+
+func main() { strings.TrimS }
+`,
+	},
+	{
+		"strings",
+		`package main
+
+import (
+	"fmt"
+)
+
+func main() { strin‸ }
+`,
+		`package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func main() { strin }
+`,
+	},
+	{
+		"TrimSpace",
+		`package main
+
+// #include <stdio.h>
+import "C"
+
+func main() { strings.TrimS‸ }
+`,
+		`package main
+
+// #include <stdio.h>
+import "C"
+import "strings"
+
+func main() { strings.TrimS }
+`,
+	},
+	{
+		"CSS",
+		`package main
+
+import "fmt"
+
+func main() {
+	var x template.HTML
+	template.C‸
+}
+`,
+		`package main
+
+import (
+	"fmt"
+	"html/template"
+)
+
+func main() {
+	var x template.HTML
+	template.C
+}
+`,
+	},
+	{
+		"Print",
+		`package main
+
+import "fmt"
+
+func main() { fmt.Pri‸ }
+`,
+		`package main
+
+import "fmt"
+
+func main() { fmt.Pri }
+`,
+	},
+}
+
+func TestImportEdits(t *testing.T) {
+	for _, test := range importTests {
+		src, offset := cursor(t, test.src)
+		res := index.Query("", src, offset, Active)
+		var s *Suggestion
+		for i := range res.Suggest {
+			if res.Suggest[i].Name == test.name {
+				s = &res.Suggest[i]
+			}
+		}
+		if s == nil {
+			t.Errorf("%s: not suggested in:\n%s", test.name, src)
+			continue
+		}
+		got := src
+		for i := len(s.Edits) - 1; i >= 0; i-- {
+			e := s.Edits[i]
+			got = got[:e.Range.Pos] + e.Text + got[e.Range.End:]
+		}
+		if got != test.want {
+			t.Errorf("%s: got:\n%s\nwant:\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+var rangeTests = []struct {
+	name string
+	src  string
+	text string // replaced by the suggestions
+}{
+	{
+		"scope name",
+		`package main
+
+		func main() {
+			var fried int
+			fr‸
+		}`,
+		"fr",
+	},
+	{
+		"selector",
+		`package main
+
+		import "fmt"
+
+		func main() { fmt.Pr‸ }`,
+		"Pr",
+	},
+	{
+		"fake identifier",
+		`package main
+
+		import "fmt"
+
+		func main() {
+			fmt.‸
+			x := 1
+		}`,
+		"",
+	},
+	{
+		"cursor inside the identifier",
+		`package main
+
+		import "fmt"
+
+		func main() { fmt.Pr‸in }`,
+		"Prin",
+	},
+	{
+		"unimported package",
+		`package main
+
+		func main() { htt‸ }`,
+		"htt",
+	},
+	{
+		"comment before the package clause",
+		`// Copyright 2014 The Go Authors.
+
+		package main
+
+		import "fmt"
+
+		func main() { fmt.Pr‸ }`,
+		"Pr",
+	},
+}
+
+func TestSuggestRange(t *testing.T) {
+	for _, test := range rangeTests {
+		src, offset := cursor(t, test.src)
+		res := index.Query("", src, offset, Active)
+		if len(res.Suggest) == 0 {
+			t.Errorf("%q: no suggestions", test.name)
+			continue
+		}
+		for _, s := range res.Suggest {
+			r := s.Range
+			if r.Pos < 0 || r.Pos > r.End || r.End > len(src) || src[r.Pos:r.End] != test.text || r.Pos > offset {
+				t.Errorf("%q: %s has range %v, want %q", test.name, s.Name, r, test.text)
+				break
+			}
+		}
+	}
+}
+
+type wantError struct {
+	line, col int
+	text      string // underlined
+	msg       string
+}
+
+var errorTests = []struct {
+	name string
+	src  string
+	want []wantError // the first errors, or nil for none
+}{
+	{
+		"fake identifier is not an error",
+		`package main
+
+import "fmt"
+
+func main() { fmt.‸ }`,
+		nil,
+	},
+	{
+		"errors are positioned",
+		`package main
+
+var x = )
+
+var y = ]
+
+func main() { f‸ }`,
+		[]wantError{
+			{3, 9, ")", "expected operand, found ')'"},
+			{5, 1, "var", "expected ';', found 'var'"},
+			{5, 9, "]", "expected operand, found ']'"},
+		},
+	},
+	{
+		"positions after the fake identifier",
+		`package main
+
+func main() {
+	fmt.‸"x"
+}`,
+		[]wantError{
+			{4, 6, "\"", "expected ';', found \"x\""},
+		},
+	},
+}
+
+func TestErrors(t *testing.T) {
+	for _, test := range errorTests {
+		src, offset := cursor(t, test.src)
+		res := index.Query("", src, offset, Passive)
+		var got []wantError
+		for _, e := range res.Error {
+			if e.Severity != SeverityError {
+				t.Errorf("%q: %s has severity %q", test.name, e.Error, e.Severity)
+			}
+			got = append(got, wantError{e.Line, e.Column, src[e.Range.Pos:e.Range.End], e.Error})
+		}
+		// Past the first few errors, the parser
+		// usually complains about the end of the file.
+		if test.want != nil && len(got) > len(test.want) {
+			got = got[:len(test.want)]
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q:\ngot  %v\nwant %v", test.name, got, test.want)
+		}
+	}
+}
+
+var relatedTests = []struct {
+	name      string
+	src       string
+	typeCheck bool  // only with type checking
+	lines     []int // of the related identifiers
+}{
+	{
+		"local variable, not shadowed",
+		`package main
+
+func main() {
+	x := 1
+	x++
+	{
+		x := 2
+		x++
+	}
+	println(x‸)
+}`,
+		false,
+		[]int{4, 5, 10},
+	},
+	{
+		"shadowing variable",
+		`package main
+
+func main() {
+	x := 1
+	{
+		x := 2
+		println(x‸)
+	}
+	println(x)
+}`,
+		false,
+		[]int{6, 7},
+	},
+	{
+		"shadowed in its own declaration",
+		`package main
+
+func main() {
+	x := 1
+	{
+		x := x‸ + 1
+		println(x)
+	}
+}`,
+		false,
+		[]int{4, 6},
+	},
+	{
+		"declaration shadowing",
+		`package main
+
+func main() {
+	x := 1
+	{
+		x‸ := x + 1
+		println(x)
+	}
+}`,
+		false,
+		[]int{6, 7},
+	},
+	{
+		"package variable, not fields",
+		`package main
+
+var count int
+
+type T struct{ count int }
+
+func f(t T) int {
+	return t.count + count
+}
+
+func main() {
+	println(count‸)
+}`,
+		false,
+		[]int{3, 8, 12},
+	},
+	{
+		"parameter",
+		`package main
+
+func f(n int) int {
+	if n > 1 {
+		return n‸ * f(n-1)
+	}
+	return 1
+}`,
+		false,
+		[]int{3, 4, 5, 5},
+	},
+	{
+		"imported package",
+		`package main
+
+import "strings"
+
+func main() {
+	strings.ToUpper("a")
+	strings‸.ToLower("b")
+}`,
+		false,
+		[]int{6, 7},
+	},
+	{
+		"field",
+		`package main
+
+type T struct{ name string }
+
+func main() {
+	t := T{name: "a"}
+	println(t.name‸)
+}`,
+		true,
+		[]int{3, 6, 7},
+	},
+	{
+		"type switch variable",
+		`package main
+
+func main() {
+	var x interface{}
+	switch v := x.(type) {
+	case int:
+		println(v‸)
+	case string:
+		println(v)
+	}
+	v := 1
+	println(v)
+}`,
+		false,
+		[]int{5, 7, 9},
+	},
+	{
+		"range variable in a closure",
+		`package main
+
+func main() {
+	for i := range []int{} {
+		go func(n int) {
+			println(i‸, n)
+		}(i)
+		i := 0
+		println(i)
+	}
+}`,
+		false,
+		[]int{4, 6, 7},
+	},
+	{
+		"while completing",
+		`package main
+
+func main() {
+	total := 0
+	println(tot‸)
+}`,
+		false,
+		nil,
+	},
+}
+
+func TestRelated(t *testing.T) {
+	typed := typedIndex()
+	for _, x := range []*Index{index, typed} {
+		for _, test := range relatedTests {
+			if test.typeCheck && !x.TypeCheck {
+				continue
+			}
+			src, offset := cursor(t, test.src)
+			res := x.Query("", src, offset, Passive)
+			var lines []int
+			for _, r := range res.Related {
+				lines = append(lines, 1+strings.Count(src[:r.Pos], "\n"))
+				if r.End <= r.Pos || strings.ContainsAny(src[r.Pos:r.End], " .") {
+					t.Errorf("%s (typecheck=%v): bad range %q", test.name, x.TypeCheck, src[r.Pos:r.End])
+				}
+			}
+			if !reflect.DeepEqual(lines, test.lines) {
+				t.Errorf("%s (typecheck=%v): related lines %v, want %v", test.name, x.TypeCheck, lines, test.lines)
+			}
+		}
+	}
+}
+
+var definitionTests = []struct {
+	name string
+	src  string
+	file string // suffix of Definition.File, or "" in src
+	line int    // 0 for no definition
+}{
+	{
+		"local variable",
+		`package main
+
+func main() {
+	total := 0
+	println(total‸)
+}`,
+		"", 4,
+	},
+	{
+		"shadowed in its own declaration",
+		`package main
+
+func main() {
+	n := 1
+	for {
+		n := n‸ + 1
+		println(n)
+	}
+}`,
+		"", 4,
+	},
+	{
+		"type in the file",
+		`package main
+
+type point struct{ X, Y int }
+
+func main() {
+	var p point‸
+}`,
+		"", 3,
+	},
+	{
+		"field of a type in the file",
+		`package main
+
+type point struct {
+	X, Y int
+}
+
+func main() {
+	p := point{}
+	println(p.Y‸)
+}`,
+		"", 4,
+	},
+	{
+		"package function",
+		`package main
+
+import "fmt"
+
+func main() { fmt.Println‸() }`,
+		"fmt/print.go", -1,
+	},
+	{
+		"method of a package type",
+		`package main
+
+import "bytes"
+
+func main() {
+	var b bytes.Buffer
+	b.WriteString‸("x")
+}`,
+		"bytes/buffer.go", -1,
+	},
+	{
+		"unknown",
+		`package main
+
+func main() { undefined‸() }`,
+		"", 0,
+	},
+}
+
+func TestDefinition(t *testing.T) {
+	typed := typedIndex()
+	for _, x := range []*Index{index, typed} {
+		for _, test := range definitionTests {
+			src, offset := cursor(t, test.src)
+			def := x.Definition("", src, offset)
+			if test.line == 0 {
+				if def != nil {
+					t.Errorf("%s (typecheck=%v): got %+v, want none", test.name, x.TypeCheck, def)
+				}
+				continue
+			}
+			if def == nil {
+				t.Errorf("%s (typecheck=%v): no definition", test.name, x.TypeCheck)
+				continue
+			}
+			if test.file == "" {
+				if def.File != "" || def.Line != test.line || src[def.Range.Pos:def.Range.End] != def.Name {
+					t.Errorf("%s (typecheck=%v): got %+v, want line %d", test.name, x.TypeCheck, def, test.line)
+				}
+				continue
+			}
+			if !strings.HasSuffix(def.File, test.file) || def.Line <= 0 {
+				t.Errorf("%s (typecheck=%v): got %+v, want in %s", test.name, x.TypeCheck, def, test.file)
+				continue
+			}
+			b, err := ioutil.ReadFile(def.File)
+			if err != nil {
+				t.Fatal(err)
+			}
+			line := strings.Split(string(b), "\n")[def.Line-1]
+			if !strings.HasPrefix(line[def.Column-1:], def.Name) {
+				t.Errorf("%s (typecheck=%v): %s:%d:%d is %q", test.name, x.TypeCheck, def.File, def.Line, def.Column, line)
+			}
+		}
+	}
+}
+
+var hoverTests = []struct {
+	name      string
+	src       string
+	kind, typ string
+	doc       string // prefix, with newlines as spaces
+}{
+	{
+		"package function",
+		`package main
+
+import "fmt"
+
+func main() { fmt.Println‸("hi") }`,
+		"func", "func(a ...any) (n int, err error)",
+		"Println formats using the default formats",
+	},
+	{
+		"package",
+		`package main
+
+import "flag"
+
+func main() { flag‸.Parse() }`,
+		"package", `"flag"`,
+		flagDoc,
+	},
+	{
+		"local variable",
+		`package main
+
+func main() {
+	// total counts things.
+	total := 0
+	println(total‸)
+}`,
+		"var", "int",
+		"",
+	},
+	{
+		"local constant",
+		`package main
+
+func main() {
+	const limit int64 = 3
+	println(limit‸)
+}`,
+		"const", "int64",
+		"",
+	},
+	{
+		"function in the file",
+		`package main
+
+// helper helps.
+func helper(n int) string { return "" }
+
+func main() { println(helper‸(1)) }`,
+		"func", "func(n int) string",
+		"helper helps.",
+	},
+	{
+		"field of a local type",
+		`package main
+
+type point struct {
+	// X is across.
+	X int
+}
+
+func main() {
+	var p point
+	println(p.X‸)
+}`,
+		"field", "int",
+		"X is across.",
+	},
+	{
+		"local type",
+		`package main
+
+// A point is a place.
+type point struct{ X int }
+
+func main() {
+	var p point‸
+}`,
+		"type", "type point struct",
+		"A point is a place.",
+	},
+	{
+		"method of a package type",
+		`package main
+
+import "bytes"
+
+func main() {
+	var b bytes.Buffer
+	b.Len‸()
+}`,
+		"method", "func() int",
+		"Len returns the number of bytes",
+	},
+	{
+		"package type",
+		`package main
+
+import "bytes"
+
+func main() { var b bytes.Buffer‸ }`,
+		"type", "type Buffer struct",
+		"A Buffer is a variable-sized buffer of bytes",
+	},
+	{
+		"package variable",
+		`package main
+
+import "os"
+
+func main() { println(os.Args‸) }`,
+		"var", "[]string",
+		"Args hold the command-line arguments",
+	},
+}
+
+func TestHover(t *testing.T) {
+	typed := typedIndex()
+	for _, x := range []*Index{index, typed} {
+		for _, test := range hoverTests {
+			src, offset := cursor(t, test.src)
+			h := x.Hover("", src, offset)
+			if h == nil {
+				t.Errorf("%s (typecheck=%v): no hover", test.name, x.TypeCheck)
+				continue
+			}
+			doc := strings.Replace(h.Doc, "\n", " ", -1)
+			if h.Kind != test.kind || h.Type != test.typ || !strings.HasPrefix(doc, test.doc) || src[h.Range.Pos:h.Range.End] != h.Name {
+				t.Errorf("%s (typecheck=%v): got %s %s %q %q, want %s %q %q", test.name, x.TypeCheck, h.Kind, h.Name, h.Type, h.Doc, test.kind, test.typ, test.doc)
+			}
+		}
+	}
+}
+
+// siblingFiles are the other files of the package in siblingTests.
+var siblingFiles = map[string]string{
+	"server.go": `package svc
+
+type server struct{ addr string }
+
+// newServer makes a server.
+func newServer() *server { return &server{} }
+
+func (s *server) listen() {}
+`,
+	"server_test.go": `package svc
+
+var newTestServer = newServer()
+`,
+	"other.go": `package other
+
+var newOther int
+`,
+	"ignored.go": `// +build ignore
+
+package svc
+
+var newIgnored int
+`,
+}
+
+var siblingTests = []struct {
+	name string
+	src  string // of handler.go
+	want []string
+}{
+	{
+		"unexported declarations",
+		`package svc
+
+func handle() {
+	new‸
+}`,
+		[]string{"newServer"},
+	},
+	{
+		"fields and methods",
+		`package svc
+
+func handle() {
+	newServer().‸
+}`,
+		[]string{"addr", "listen"},
+	},
+	{
+		"methods in the queried file",
+		`package svc
+
+func (s *server) close() {}
+
+func handle(s *server) {
+	s.‸
+}`,
+		[]string{"addr", "close", "listen"},
+	},
+	{
+		"shadowed by the queried file",
+		`package svc
+
+func handle() {
+	newServer := 1
+	if newS‸
+}`,
+		[]string{"newServer"},
+	},
+}
+
+// tempTree writes files, keyed by slash-separated path, under
+// a new temporary directory, which it returns.
+func tempTree(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "gofill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, src := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(src), 0666); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestSiblings(t *testing.T) {
+	dir := tempTree(t, siblingFiles)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "handler.go")
+
+	typed := typedIndex()
+	for _, x := range []*Index{index, typed} {
+		for _, test := range siblingTests {
+			src, offset := cursor(t, test.src)
+			res := x.Query(filename, src, offset, Passive)
+			var got []string
+			for _, s := range res.Suggest {
+				got = append(got, s.Name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s (typecheck=%v): got %v, want %v", test.name, x.TypeCheck, got, test.want)
+			}
+		}
+
+		src := "package svc\n\nfunc handle() { newServer() }"
+		offset := strings.Index(src, "newServer")
+		def := x.Definition(filename, src, offset)
+		if def == nil || def.File != filepath.Join(dir, "server.go") || def.Line != 6 {
+			t.Errorf("typecheck=%v: definition %+v, want server.go:6", x.TypeCheck, def)
+		}
+		h := x.Hover(filename, src, offset)
+		if h == nil || h.Kind != "func" || h.Doc != "newServer makes a server.\n" {
+			t.Errorf("typecheck=%v: hover %+v, want newServer's doc", x.TypeCheck, h)
+		}
+	}
+}
+
+func TestSiblingCache(t *testing.T) {
+	dir := tempTree(t, siblingFiles)
+	defer os.RemoveAll(dir)
+	x := &Index{pkgNames: index.pkgNames, pkgs: index.pkgs}
+	filename := filepath.Join(dir, "handler.go")
+	src, offset := cursor(t, "package svc\n\nfunc handle() {\n\tnew‸\n}")
+	suggest := func() []string {
+		var names []string
+		for _, s := range x.Query(filename, src, offset, Passive).Suggest {
+			names = append(names, s.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	parsed := func() *ast.File {
+		return x.siblings[absPath(dir)].files[0]
+	}
+
+	suggest()
+	first := parsed()
+	suggest()
+	if parsed() != first {
+		t.Errorf("unchanged siblings parsed again")
+	}
+
+	server := "package svc\n\nfunc newServer() {}\n\nfunc newServerFrom() {}\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "server.go"), []byte(server), 0666); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"newServer", "newServerFrom"}
+	if got := suggest(); !reflect.DeepEqual(got, want) {
+		t.Errorf("after a change on disk: got %v, want %v", got, want)
+	}
+	if parsed() == first {
+		t.Errorf("changed siblings not parsed again")
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	dir := tempTree(t, map[string]string{
+		"store/store.go": "package store\n\nfunc Get() {}\n",
+		"svc/server.go":  "package svc\n\nfunc newServer() {}\n",
+	})
+	defer os.RemoveAll(dir)
+	storeDir := filepath.Join(dir, "store")
+	svcDir := filepath.Join(dir, "svc")
+
+	indexer := &Indexer{Fset: token.NewFileSet()}
+	f, err := parser.ParseFile(indexer.Fset, filepath.Join(storeDir, "store.go"), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexer.AddFile("example.com/store", f)
+	x := indexer.Index()
+
+	filename := filepath.Join(svcDir, "handler.go")
+	suggest := func(src string) []string {
+		src, offset := cursor(t, src)
+		var names []string
+		for _, s := range x.Query(filename, src, offset, Passive).Suggest {
+			names = append(names, s.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	local := "package svc\n\nfunc handle() {\n\tnew‸\n}"
+	imported := "package svc\n\nimport \"example.com/store\"\n\nfunc handle() {\n\tstore.‸\n}"
+	nested := "package svc\n\nimport \"example.com/store/cache\"\n\nfunc handle() {\n\tcache.‸\n}"
+
+	// Overlay paths may be relative, as long as they name the
+	// same file.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relStore, err := filepath.Rel(wd, filepath.Join(storeDir, "store.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		set, drop string // overlay changes
+		src       string // overlay contents
+		query     string
+		want      []string
+	}{
+		{"", "", "", local, []string{"newServer"}},
+		{"svc/server.go", "", "package svc\n\nfunc newServerWithPort() {}\n", local, []string{"newServerWithPort"}},
+		{"svc/extra.go", "", "package svc\n\nfunc newExtra() {}\n", local, []string{"newExtra", "newServerWithPort"}},
+		{"", "svc/server.go", "", local, []string{"newExtra", "newServer"}},
+		{"", "", "", imported, []string{"Get"}},
+		{"store/store.go", "", "package store\n\nfunc Put() {}\n", imported, []string{"Put"}},
+		{"store/new.go", "", "package store\n\nfunc Delete() {}\n", imported, []string{"Delete", "Put"}},
+		{"", "store/store.go", "", imported, []string{"Delete", "Get"}},
+		{relStore, "", "package store\n\nfunc Close() {}\n", imported, []string{"Close", "Delete"}},
+		{"", "store/store.go", "", imported, []string{"Delete", "Get"}},
+		{"store/cache/cache.go", "", "package cache\n\nfunc Purge() {}\n", nested, []string{"Purge"}},
+	}
+	for i, step := range steps {
+		if step.set != "" {
+			path := step.set
+			if path != relStore {
+				path = filepath.Join(dir, path)
+			}
+			x.SetOverlay(path, step.src)
+		}
+		if step.drop != "" {
+			x.DropOverlay(filepath.Join(dir, step.drop))
+		}
+		if got := suggest(step.query); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("step %d: got %v, want %v", i, got, step.want)
+		}
+	}
+}
+
+var modFileTests = []struct {
+	name string
+	data string
+	want *modFile // nil for an error
+}{
+	{
+		"single line",
+		"module example.com/m\n\ngo 1.21\n\nrequire example.com/dep v1.0.0\n",
+		&modFile{"example.com/m", []modVersion{{"example.com/dep", "v1.0.0"}}, nil},
+	},
+	{
+		"blocks and comments",
+		`// The service.
+module "mycompany.com/svc"
+
+require (
+	example.com/a v1.2.3 // indirect
+	example.com/B v0.0.0-20140101000000-abcdef123456
+)
+`,
+		&modFile{"mycompany.com/svc", []modVersion{
+			{"example.com/a", "v1.2.3"},
+			{"example.com/B", "v0.0.0-20140101000000-abcdef123456"},
+		}, nil},
+	},
+	{
+		"replace",
+		`module m
+
+replace example.com/a => ./forks/a
+replace (
+	example.com/b v1.0.0 => example.com/c v1.1.0
+	example.com/d => /src/d
+)
+`,
+		&modFile{"m", nil, []modReplace{
+			{modVersion{"example.com/a", ""}, modVersion{"./forks/a", ""}},
+			{modVersion{"example.com/b", "v1.0.0"}, modVersion{"example.com/c", "v1.1.0"}},
+			{modVersion{"example.com/d", ""}, modVersion{"/src/d", ""}},
+		}},
+	},
+	{
+		"replace without arrow",
+		"module m\nreplace example.com/a ./forks/a\n",
+		nil,
+	},
+	{
+		"replace module without version",
+		"module m\nreplace example.com/a => example.com/b\n",
+		nil,
+	},
+	{
+		"no module",
+		"require example.com/dep v1.0.0\n",
+		nil,
+	},
+	{
+		"bad require",
+		"module m\nrequire example.com/dep\n",
+		nil,
+	},
+}
+
+func TestParseModFile(t *testing.T) {
+	for _, test := range modFileTests {
+		mf, err := parseModFile([]byte(test.data))
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: got %+v, want error", test.name, mf)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(mf, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, mf, test.want)
+		}
+	}
+}
+
+func TestParseWorkFile(t *testing.T) {
+	data := `go 1.21
+
+use ./svc
+use (
+	./lib // the shared code
+	"/src/tools"
+)
+
+replace example.com/a v1.0.0 => ../a
+`
+	wf, err := parseWorkFile([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &workFile{
+		use:     []string{"./svc", "./lib", "/src/tools"},
+		replace: []modReplace{{modVersion{"example.com/a", "v1.0.0"}, modVersion{"../a", ""}}},
+	}
+	if !reflect.DeepEqual(wf, want) {
+		t.Errorf("got %+v, want %+v", wf, want)
+	}
+}
+
+var semverTests = []struct {
+	v, w string
+	less bool
+}{
+	{"v1.9.0", "v1.10.0", true},
+	{"v1.10.0", "v1.9.0", false},
+	{"v1.2.3", "v1.2.3", false},
+	{"v1.2.3", "v2.0.0", true},
+	{"v1.0.0-rc.1", "v1.0.0", true},
+	{"v1.0.0", "v1.0.0-rc.1", false},
+	{"v1.0.0-rc.2", "v1.0.0-rc.10", true},
+	{"v1.0.0-1", "v1.0.0-alpha", true},
+	{"v1.0.0-alpha", "v1.0.0-alpha.1", true},
+	{"v1.0.0-alpha", "v1.0.0-beta", true},
+	{"v0.0.0-20140101000000-abcdef123456", "v0.0.0-20150101000000-abcdef123456", true},
+	{"v1.0.0+build.2", "v1.0.0+build.1", false},
+}
+
+func TestSemverLess(t *testing.T) {
+	for _, test := range semverTests {
+		if got := semverLess(test.v, test.w); got != test.less {
+			t.Errorf("semverLess(%q, %q) = %v, want %v", test.v, test.w, got, test.less)
+		}
+	}
+}
+
+func indexedPaths(x *Index) []string {
+	var paths []string
+	for path := range x.pkgs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestModuleIndexer(t *testing.T) {
+	dir := tempTree(t, map[string]string{
+		"svc/go.mod":                           "module mycompany.com/svc\n\nrequire (\n\texample.com/Dep v1.2.0\n\texample.com/missing v1.0.0\n)\n",
+		"svc/main.go":                          "package main\n",
+		"svc/store/store.go":                   "package store\n\nfunc Get() {}\n",
+		"svc/store/testdata/x.go":              "package x\n\nfunc Skipped() {}\n",
+		"svc/tools/go.mod":                     "module mycompany.com/svc/tools\n",
+		"svc/tools/tools.go":                   "package tools\n",
+		"cache/example.com/!dep@v1.2.0/dep.go": "package dep\n\nfunc Do() {}\n",
+	})
+	defer os.RemoveAll(dir)
+	defer os.Setenv("GOMODCACHE", os.Getenv("GOMODCACHE"))
+	defer os.Setenv("GOWORK", os.Getenv("GOWORK"))
+	os.Setenv("GOMODCACHE", filepath.Join(dir, "cache"))
+	os.Setenv("GOWORK", "")
+
+	p := &simpleIndexer{m: &Indexer{Fset: token.NewFileSet()}}
+	if err := p.loadModule(filepath.Join(dir, "svc", "store")); err != nil {
+		t.Fatal(err)
+	}
+	x := p.m.Index()
+
+	want := []string{"example.com/Dep", "mycompany.com/svc", "mycompany.com/svc/store"}
+	if paths := indexedPaths(x); !reflect.DeepEqual(paths, want) {
+		t.Errorf("indexed %v, want %v", paths, want)
+	}
+
+	src := "package main\n\nimport (\n\t\"example.com/Dep\"\n\t\"mycompany.com/svc/store\"\n)\n\nfunc main() {\n\tstore.G\n\tdep.D\n}\n"
+	for _, sel := range []string{"store.G", "dep.D"} {
+		offset := strings.Index(src, sel) + len(sel)
+		res := x.Query(filepath.Join(dir, "svc", "main.go"), src, offset, Passive)
+		if len(res.Suggest) != 1 || !strings.HasPrefix(res.Suggest[0].Name, sel[len(sel)-1:]) {
+			t.Errorf("%s: got %+v", sel, res.Suggest)
+		}
+	}
+}
+
+func TestWorkspace(t *testing.T) {
+	dir := tempTree(t, map[string]string{
+		"go.work": "go 1.21\n\nuse (\n\t./svc\n\t./lib\n)\n\nreplace example.com/Dep => ./forks/dep\n",
+		"svc/go.mod": `module mycompany.com/svc
+
+require (
+	mycompany.com/lib v0.0.0
+	example.com/Dep v1.2.0
+	example.com/old v1.0.0
+	example.com/shared v1.9.0
+)
+
+replace example.com/old => example.com/fork v1.1.0
+replace example.com/Dep => example.com/Dep v1.3.0
+`,
+		"svc/main.go":                           "package main\n",
+		"lib/go.mod":                            "module mycompany.com/lib\n\nrequire example.com/shared v1.10.0\n",
+		"lib/lib.go":                            "package lib\n",
+		"forks/dep/go.mod":                      "module example.com/Dep\n",
+		"forks/dep/dep.go":                      "package dep\n\nfunc Patched() {}\n",
+		"cache/example.com/!dep@v1.3.0/dep.go":  "package dep\n\nfunc Released() {}\n",
+		"cache/example.com/fork@v1.1.0/old.go":  "package old\n\nfunc Forked() {}\n",
+		"cache/example.com/shared@v1.9.0/s.go":  "package shared\n\nfunc Old() {}\n",
+		"cache/example.com/shared@v1.10.0/s.go": "package shared\n\nfunc New() {}\n",
+	})
+	defer os.RemoveAll(dir)
+	defer os.Setenv("GOMODCACHE", os.Getenv("GOMODCACHE"))
+	defer os.Setenv("GOWORK", os.Getenv("GOWORK"))
+	os.Setenv("GOMODCACHE", filepath.Join(dir, "cache"))
+	os.Setenv("GOWORK", "")
+
+	p := &simpleIndexer{m: &Indexer{Fset: token.NewFileSet()}}
+	if err := p.loadModule(filepath.Join(dir, "svc")); err != nil {
+		t.Fatal(err)
+	}
+	x := p.m.Index()
+
+	want := []string{"example.com/Dep", "example.com/old", "example.com/shared", "mycompany.com/lib", "mycompany.com/svc"}
+	if paths := indexedPaths(x); !reflect.DeepEqual(paths, want) {
+		t.Errorf("indexed %v, want %v", paths, want)
+	}
+	for path, name := range map[string]string{
+		"example.com/Dep":    "Patched",
+		"example.com/old":    "Forked",
+		"example.com/shared": "New",
+	} {
+		if pkg := x.pkgs[path]; pkg == nil || pkg.lookup(name) == nil {
+			t.Errorf("%s: %s not indexed", path, name)
+		}
+	}
+	if got, want := x.pkgNames["dep"], map[string]bool{"example.com/Dep": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf(`pkgNames["dep"] = %v, want %v`, got, want)
+	}
+	if got := x.pkgNames["fork"]; got != nil {
+		t.Errorf(`pkgNames["fork"] = %v, want none`, got)
+	}
+
+	// Without the go.work file, only svc and its own replacements.
+	os.Setenv("GOWORK", "off")
+	p = &simpleIndexer{m: &Indexer{Fset: token.NewFileSet()}}
+	if err := p.loadModule(filepath.Join(dir, "svc")); err != nil {
+		t.Fatal(err)
+	}
+	x = p.m.Index()
+	if pkg := x.pkgs["example.com/Dep"]; pkg == nil || pkg.lookup("Released") == nil {
+		t.Errorf("GOWORK=off: example.com/Dep not replaced by v1.3.0")
+	}
+	if x.pkgs["mycompany.com/lib"] != nil {
+		t.Errorf("GOWORK=off: mycompany.com/lib indexed")
+	}
+}
+
+func TestImportCycle(t *testing.T) {
+	dir := tempTree(t, map[string]string{
+		"go.mod": "module m\n",
+		"a/a.go": "package a\n\nimport \"m/b\"\n\nfunc Apply() { b.Bind() }\n",
+		"b/b.go": "package b\n\nimport \"m/a\"\n\nfunc Bind() { a.Apply() }\n",
+	})
+	defer os.RemoveAll(dir)
+	defer os.Setenv("GOWORK", os.Getenv("GOWORK"))
+	os.Setenv("GOWORK", "")
+
+	p := &simpleIndexer{m: &Indexer{Fset: token.NewFileSet()}}
+	if err := p.loadModule(dir); err != nil {
+		t.Fatal(err)
+	}
+	x := p.m.Index()
+	x.TypeCheck = true
+
+	src := "package main\n\nimport \"m/a\"\n\nfunc main() {\n\ta.\n}\n"
+	offset := strings.Index(src, "a.\n") + len("a.")
+	done := make(chan []Suggestion)
+	go func() {
+		done <- x.Query(filepath.Join(dir, "main.go"), src, offset, Passive).Suggest
+	}()
+	select {
+	case got := <-done:
+		if len(got) != 1 || got[0].Name != "Apply" {
+			t.Errorf("got %+v, want Apply", got)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Query deadlocked on an import cycle")
+	}
+}
+
+var nameIndexTests = []struct {
+	s      string
+	prefix bool
+	want   []string
+}{
+	{"new", true, []string{"newline", "NewReader", "NewReplacer"}},
+	{"NewRe", true, []string{"NewReader", "NewReplacer"}},
+	{"", true, []string{"newline", "NewReader", "NewReplacer", "r", "Reader"}},
+	{"read", true, []string{"Reader"}},
+	{"r", true, []string{"r", "Reader"}},
+	{"R", true, []string{"r", "Reader"}},
+	{"x", true, nil},
+	{"\x00r", true, nil},
+	{"read", false, []string{"NewReader", "Reader"}},
+	{"r", false, []string{"NewReader", "NewReplacer", "r", "Reader"}},
+	{"LINE", false, []string{"newline"}},
+	{"ewl", false, []string{"newline"}},
+	{"x", false, nil},
+	{"\x00r", false, nil},
+}
+
+func TestNameIndex(t *testing.T) {
+	ix := newNameIndex([]string{"NewReader", "NewReplacer", "Reader", "newline", "r"})
+	for _, test := range nameIndexTests {
+		lookup := ix.containing
+		if test.prefix {
+			lookup = ix.withPrefix
+		}
+		var got []string
+		for _, i := range lookup(test.s) {
+			got = append(got, ix.names[i])
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("prefix=%v %q: got %v, want %v", test.prefix, test.s, got, test.want)
+		}
+	}
+}
+
+var candidateTests = []struct {
+	pattern  string
+	prefixed []string
+	others   []string
+}{
+	{"NewRe", []string{"NewReader", "NewReplacer"}, []string{"newline"}},
+	{"new", []string{"newline", "NewReader", "NewReplacer"}, nil},
+	{"rd", nil, []string{"r", "Reader"}},
+	{"x", nil, nil},
+}
+
+func TestNameIndexCandidates(t *testing.T) {
+	ix := newNameIndex([]string{"NewReader", "NewReplacer", "Reader", "newline", "r"})
+	for _, test := range candidateTests {
+		idx, n := ix.candidates(test.pattern)
+		var prefixed, others []string
+		for k, i := range idx {
+			if k < n {
+				prefixed = append(prefixed, ix.names[i])
+			} else {
+				others = append(others, ix.names[i])
+			}
+		}
+		if !reflect.DeepEqual(prefixed, test.prefixed) || !reflect.DeepEqual(others, test.others) {
+			t.Errorf("%q: got %v then %v, want %v then %v", test.pattern, prefixed, others, test.prefixed, test.others)
+		}
+	}
+}
+
+// allNames returns every declaration in the index, standing
+// in for a large GOPATH.
+func allNames() []string {
+	var names []string
+	for _, pkg := range index.pkgs {
+		for _, d := range pkg.decls {
+			names = append(names, d.name)
+		}
+	}
+	return names
+}
+
+func BenchmarkNameSubstringScan(b *testing.B) {
+	names := allNames()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := 0
+		for _, name := range names {
+			if strings.Contains(strings.ToLower(name), "reader") {
+				n++
+			}
+		}
+	}
+}
+
+func BenchmarkNameSubstringIndex(b *testing.B) {
+	ix := newNameIndex(allNames())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ix.containing("reader")
+	}
+}
+
+func BenchmarkRelated(b *testing.B) {
+	var buf bytes.Buffer
+	buf.WriteString("package main\n\nfunc main() {\n\tvar err error\n")
+	for i := 0; i < 4000; i++ {
+		buf.WriteString("\tprintln(err)\n")
+	}
+	buf.WriteString("\tprintln(err)\n}\n")
+	src := buf.String()
+	offset := len(src) - len(")\n}\n")
+	for i := 0; i < b.N; i++ {
+		if res := index.Query("", src, offset, Passive); len(res.Related) != 4002 {
+			b.Fatalf("%d related, want 4002", len(res.Related))
+		}
+	}
+}
+
+// BenchmarkPkgSearchScan matches every declaration of a large
+// package, as pkgSearch did before the name index.
+func BenchmarkPkgSearchScan(b *testing.B) {
+	pkg := index.pkgs["syscall"]
+	for i := 0; i < b.N; i++ {
+		query := &queryState{}
+		for _, d := range pkg.decls {
+			if !ast.IsExported(d.name) {
+				continue
+			}
+			if score, matched := match("SYS_W", d.name); score > 0 {
+				query.suggest(Suggestion{Name: d.name, Matches: matched}, score, levelImported, token.NoPos)
+			}
+		}
+	}
+}
+
+func BenchmarkPkgSearch(b *testing.B) {
+	pkg := index.pkgs["syscall"]
+	for i := 0; i < b.N; i++ {
+		query := &queryState{}
+		index.pkgSearch(query, pkg, "SYS_W")
+	}
+}
+
+func BenchmarkQuery(b *testing.B) {
+	src := "package main\n\nimport \"syscall\"\n\nfunc main() {\n\tsyscall.SYS_W\n}\n"
+	offset := strings.Index(src, "SYS_W") + len("SYS_W")
+	for i := 0; i < b.N; i++ {
+		index.Query("", src, offset, Passive)
+	}
+}
+
+var index *Index
+
+func init() {
+	index = SimpleIndexer()
+	index.pkgs["fake/go-fakepkg"] = &pkgDecl{
+		shortName: "fakepkg",
+	}
+	// Packages whose names share a prefix no standard
+	// library package has, for inferring package names.
+	for _, name := range []string{"fakefile", "fakefilepath"} {
+		path := "fake/" + name
+		index.pkgs[path] = &pkgDecl{path: path, shortName: name}
+		index.pkgNames[name] = map[string]bool{path: true}
+	}
+	// A package whose declarations do not change with Go versions.
+	indexer := &Indexer{Fset: token.NewFileSet()}
+	f, err := parser.ParseFile(indexer.Fset, "fakeprint.go", fakeprintSrc, 0)
+	if err != nil {
+		panic(err)
+	}
+	indexer.AddFile("fake/fakeprint", f)
+	index.pkgs["fake/fakeprint"] = indexer.pkgs["fake/fakeprint"]
+	index.pkgNames["fakeprint"] = map[string]bool{"fake/fakeprint": true}
+}
+
+const fakeprintSrc = `package fakeprint
+
+type Stringer interface {
+	String() string
+}
+
+func Errorf(format string, a ...interface{}) error
+func Fprint(w io.Writer, a ...interface{}) (n int, err error)
+func Print(a ...interface{}) (n int, err error)
+func Printf(format string, a ...interface{}) (n int, err error)
+func Println(a ...interface{}) (n int, err error)
+
+func newPrinter() *pp
+`
@@ -19,6 +19,16 @@ type Handler struct {
 	x *Index
 }
 
+// NewHandler returns a handler querying x.
+func NewHandler(x *Index) *Handler {
+	return &Handler{x}
+}
+
+// Index returns the index queried by the handler.
+func (h *Handler) Index() *Index {
+	return h.x
+}
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -30,25 +40,95 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "GET or POST only", 500)
 		return
 	}
+	filename, src, offset, ok := queryArgs(w, r)
+	if !ok {
+		return
+	}
+
+	mode := Passive
+	if r.PostFormValue("mode") == "active" {
+		mode = Active
+	}
+
+	res := h.x.Query(filename, src, offset, mode)
+	writeJSON(w, res)
+}
+
+// ServeDefinition responds to a POST of src and offset with
+// the Definition of the identifier at offset, or null.
+func (h *Handler) ServeDefinition(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", 500)
+		return
+	}
+	filename, src, offset, ok := queryArgs(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, h.x.Definition(filename, src, offset))
+}
+
+// ServeHover responds to a POST of src and offset with
+// the Hover of the identifier at offset, or null.
+func (h *Handler) ServeHover(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", 500)
+		return
+	}
+	filename, src, offset, ok := queryArgs(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, h.x.Hover(filename, src, offset))
+}
+
+// ServeOverlay responds to a POST of filename and src by using
+// src as the unsaved contents of the file, or to a POST of
+// filename and drop=1 by returning to the file on disk.
+func (h *Handler) ServeOverlay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", 500)
+		return
+	}
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	//filename := r.PostFormValue("filename")
-	src := r.PostFormValue("src")
-	fmt.Printf("src: %q\n", src)
+	filename := r.PostFormValue("filename")
+	if filename == "" {
+		http.Error(w, "no filename", 500)
+		return
+	}
+	if r.PostFormValue("drop") != "" {
+		h.x.DropOverlay(filename)
+	} else {
+		h.x.SetOverlay(filename, r.PostFormValue("src"))
+	}
+	writeJSON(w, nil)
+}
+
+// queryArgs reads the file name, source and cursor offset posted
+// by the editor. If they are missing, it replies with an error.
+func queryArgs(w http.ResponseWriter, r *http.Request) (filename, src string, offset int, ok bool) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return "", "", 0, false
+	}
+	filename = r.PostFormValue("filename")
+	src = r.PostFormValue("src")
 	offset, err := strconv.Atoi(r.PostFormValue("offset"))
 	if err != nil {
 		http.Error(w, fmt.Sprintf("pos: %v", err), 500)
-		return
+		return "", "", 0, false
 	}
 	if offset >= len(src) {
 		offset = len(src) - 1
 	}
+	return filename, src, offset, true
+}
 
-	res := h.x.Query(src, offset)
-
-	b, err := json.Marshal(res)
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -0,0 +1,127 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gofill
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+
+	"code.google.com/p/go.tools/astutil"
+)
+
+// Hover describes the identifier under the cursor.
+type Hover struct {
+	Range Range
+	Name  string
+	Kind  string // as in Suggestion
+	Type  string `json:",omitempty"`
+	Doc   string `json:",omitempty"`
+}
+
+// Hover describes the identifier at offset in src, with filename
+// as for Query. It returns nil if there is no identifier there,
+// or it is unknown.
+func (x *Index) Hover(filename, src string, offset int) *Hover {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	query, id, path := x.identQuery(filename, src, offset)
+	if id == nil {
+		return nil
+	}
+	h := &Hover{
+		Range: query.rangeOf(id),
+		Name:  id.Name,
+	}
+	if query.info != nil {
+		if obj := identObj(query.info, id); obj != nil {
+			h.Kind = objKind(obj)
+			h.Type = objString(obj, query.pkg)
+			switch {
+			case h.Kind == "package":
+				if pkg := x.pkgs[obj.(*types.PkgName).Imported().Path()]; pkg != nil {
+					h.Doc = pkg.doc
+				}
+			case obj.Pkg() == query.pkg && query.inFile(obj.Pos()):
+				h.Doc = query.localDoc(obj.Pos())
+			default:
+				h.Doc = x.objDoc(obj)
+				if d := x.identDecl(query, id, path); h.Doc == "" && d != nil {
+					h.Doc = d.doc // a field
+				}
+			}
+			return h
+		}
+	}
+	if isScopeRef(path) {
+		obj, ok := lookupScope(x.pkgs, path)
+		if !ok {
+			d := query.localDecl(id.Name)
+			if d == nil {
+				return nil
+			}
+			h.Kind = kindName(d.kind, false)
+			h.Type = d.typ
+			h.Doc = d.doc
+			return h
+		}
+		h.Kind = kindName(obj.kind, false)
+		h.Type = x.scopeObjString(query, obj)
+		if obj.kind == ast.Pkg {
+			h.Doc = obj.pkg.doc
+		} else {
+			h.Doc = query.localDoc(obj.declPos)
+		}
+		return h
+	}
+	d := x.identDecl(query, id, path)
+	if d == nil {
+		return nil
+	}
+	member := true
+	if pkgID, ok := path[1].(*ast.SelectorExpr).X.(*ast.Ident); ok {
+		member = x.importedPkg(query, nil, pkgID.Name) == nil
+	}
+	h.Kind = kindName(d.kind, member)
+	h.Type = d.typ
+	h.Doc = d.doc
+	return h
+}
+
+// localDoc finds the doc comment of the declaration in the
+// queried file with its name at pos.
+func (query *queryState) localDoc(pos token.Pos) string {
+	if !pos.IsValid() {
+		return ""
+	}
+	path, _ := astutil.PathEnclosingInterval(query.f, pos, pos)
+	for i, n := range path {
+		switch n := n.(type) {
+		case *ast.Field:
+			if n.Doc != nil {
+				return n.Doc.Text()
+			}
+			return n.Comment.Text()
+		case *ast.ValueSpec:
+			if n.Doc != nil || n.Comment != nil {
+				return n.Doc.Text() + n.Comment.Text()
+			}
+		case *ast.TypeSpec:
+			if n.Doc != nil || n.Comment != nil {
+				return n.Doc.Text() + n.Comment.Text()
+			}
+		case *ast.GenDecl:
+			if i > 0 && len(n.Specs) == 1 {
+				return n.Doc.Text()
+			}
+			return ""
+		case *ast.FuncDecl:
+			return n.Doc.Text()
+		case *ast.BlockStmt:
+			return ""
+		}
+	}
+	return ""
+}
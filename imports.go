@@ -0,0 +1,192 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gofill
+
+import (
+	"go/ast"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// Edit is a change to the source accompanying a suggestion,
+// replacing the bytes in Range with Text.
+type Edit struct {
+	Range Range
+	Text  string
+}
+
+// inferImport guesses the import path of a package name that
+// is used but not imported by the queried file. Like goimports,
+// it only accepts candidates exporting every name the file
+// selects from the package, so a prior template.HTML is enough
+// to choose "html/template" over "text/template". It returns ""
+// unless exactly one candidate remains.
+func (x *Index) inferImport(query *queryState, name string) string {
+	if path, ok := query.inferred[name]; ok {
+		return path
+	}
+	var cursorSel ast.Node
+	if len(query.path) > 1 {
+		cursorSel = query.path[1]
+	}
+	used := make(map[string]bool)
+	ast.Inspect(query.f, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok || n == cursorSel {
+			return true
+		}
+		if id, ok := sel.X.(*ast.Ident); ok && id.Name == name {
+			used[sel.Sel.Name] = true
+		}
+		return true
+	})
+
+	best, n := "", 0
+	for path := range x.pkgNames[name] {
+		pkg := x.pkgs[path]
+		if pkg == nil || !canImport(path) {
+			continue
+		}
+		exportsAll := true
+		for sel := range used {
+			if !ast.IsExported(sel) || pkg.lookup(sel) == nil {
+				exportsAll = false
+				break
+			}
+		}
+		if exportsAll {
+			best, n = path, n+1
+		}
+	}
+	if n != 1 {
+		best = ""
+	}
+
+	if query.inferred == nil {
+		query.inferred = make(map[string]string)
+	}
+	query.inferred[name] = best
+	return best
+}
+
+// importEdits returns the edits that add an import of path to
+// the queried file, or nil if it is already imported.
+func (query *queryState) importEdits(path string) []Edit {
+	f := query.f
+	for _, imp := range f.Imports {
+		if p, err := strconv.Unquote(imp.Path.Value); err == nil && p == path {
+			return nil
+		}
+	}
+	// The cgo preamble is the doc comment of a lone import "C",
+	// so its declaration is left alone.
+	var all, decls []*ast.GenDecl
+	for _, d := range f.Decls {
+		if d, ok := d.(*ast.GenDecl); ok && d.Tok == token.IMPORT {
+			all = append(all, d)
+			if !importsC(d) {
+				decls = append(decls, d)
+			}
+		}
+	}
+	spec := strconv.Quote(path)
+
+	if len(all) == 0 {
+		at := query.offsetOf(f.Name.End())
+		return []Edit{{Range{at, at}, "\n\nimport " + spec}}
+	}
+	for _, d := range decls {
+		if d.Lparen.IsValid() {
+			return query.groupImportEdits(d, path)
+		}
+	}
+	if len(all) == 1 && len(decls) == 1 && len(decls[0].Specs) == 1 {
+		// Turn import "fmt" into a parenthesised group.
+		d := decls[0]
+		old := d.Specs[0].(*ast.ImportSpec)
+		oldText := query.src[query.offsetOf(old.Pos()):query.offsetOf(old.End())]
+		specs := []string{oldText, spec}
+		if importPath(old) > path {
+			specs[0], specs[1] = specs[1], specs[0]
+		}
+		text := "import (\n\t" + strings.Join(specs, "\n\t") + "\n)"
+		return []Edit{{Range{query.offsetOf(d.Pos()), query.offsetOf(d.End())}, text}}
+	}
+	at := query.offsetOf(all[len(all)-1].End())
+	return []Edit{{Range{at, at}, "\nimport " + spec}}
+}
+
+// importsC reports whether d imports "C".
+func importsC(d *ast.GenDecl) bool {
+	for _, s := range d.Specs {
+		if importPath(s.(*ast.ImportSpec)) == "C" {
+			return true
+		}
+	}
+	return false
+}
+
+// groupImportEdits adds path to a parenthesised import
+// declaration. As gofmt only sorts imports within groups
+// separated by blank lines, the new import is placed in sorted
+// order in the first group of standard library imports, or the
+// last group of other imports.
+func (query *queryState) groupImportEdits(d *ast.GenDecl, path string) []Edit {
+	spec := strconv.Quote(path)
+	if len(d.Specs) == 0 {
+		at := query.offsetOf(d.Lparen + 1)
+		return []Edit{{Range{at, at}, "\n\t" + spec + "\n"}}
+	}
+
+	var groups [][]*ast.ImportSpec
+	line := func(p token.Pos) int { return query.fset.Position(p).Line }
+	for i, s := range d.Specs {
+		s := s.(*ast.ImportSpec)
+		if i == 0 || line(s.Pos()) > line(d.Specs[i-1].End())+1 {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], s)
+	}
+
+	std := isStd(path)
+	group := groups[len(groups)-1]
+	if std {
+		group = groups[0]
+	}
+	for _, g := range groups {
+		if isStd(importPath(g[0])) == std {
+			group = g
+			if std {
+				break
+			}
+		}
+	}
+
+	for _, s := range group {
+		if importPath(s) > path {
+			at := query.offsetOf(s.Pos())
+			return []Edit{{Range{at, at}, spec + "\n\t"}}
+		}
+	}
+	at := query.offsetOf(group[len(group)-1].End())
+	return []Edit{{Range{at, at}, "\n\t" + spec}}
+}
+
+func importPath(s *ast.ImportSpec) string {
+	path, _ := strconv.Unquote(s.Path.Value)
+	return path
+}
+
+// isStd guesses whether path is in the standard library,
+// in the same way goimports does: by the lack of a dot in
+// the first path element.
+func isStd(path string) bool {
+	elem := path
+	if i := strings.Index(path, "/"); i >= 0 {
+		elem = path[:i]
+	}
+	return !strings.Contains(elem, ".")
+}
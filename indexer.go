@@ -12,10 +12,16 @@ import (
 	"go/token"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 )
 
 type Indexer struct {
+	// Fset holds the positions of the added files.
+	// If nil, declarations are indexed without positions.
+	Fset *token.FileSet
+
 	pkgNames map[string]map[string]bool // "template" -> {"html/template", "text/template"}
 	pkgs     map[string]*pkgDecl        // "text/template" -> ...
 }
@@ -44,40 +50,166 @@ func (p *Indexer) AddFile(dirname string, file *ast.File) {
 	pkgMap[dirname] = true
 	pkg := p.pkgs[dirname]
 	if pkg == nil {
-		pkg = &pkgDecl{shortName: pkgName}
+		pkg = &pkgDecl{path: dirname, shortName: pkgName}
 	}
 	p.pkgs[dirname] = pkg
+	if p.Fset != nil && pkg.dir == "" {
+		pkg.dir = filepath.Dir(p.Fset.Position(file.Package).Filename)
+	}
+	if doc := file.Doc.Text(); doc != "" {
+		// Prefer the package comment proper to other
+		// comments that happen to precede the clause.
+		if pkg.doc == "" || !strings.HasPrefix(pkg.doc, "Package ") && strings.HasPrefix(doc, "Package ") {
+			pkg.doc = doc
+		}
+	}
+
+	info := &fileInfo{pkg: pkg, fset: p.Fset}
+	for _, imp := range file.Imports {
+		path, err := strconv.Unquote(imp.Path.Value)
+		if err != nil {
+			continue
+		}
+		name := ""
+		if imp.Name != nil {
+			name = imp.Name.Name
+		}
+		info.imports = append(info.imports, fileImport{name, path})
+	}
 
 	for _, d := range file.Decls {
 		switch d := d.(type) {
 		case *ast.GenDecl:
-			if len(d.Specs) == 0 {
-				continue
-			}
-			switch s := d.Specs[0].(type) {
-			case *ast.ValueSpec:
-				for _, n := range s.Names {
+			for _, s := range d.Specs {
+				switch s := s.(type) {
+				case *ast.ValueSpec:
+					kind := ast.Var
+					if d.Tok == token.CONST {
+						kind = ast.Con
+					}
+					doc := specDoc(d, s.Doc, s.Comment)
+					for i, n := range s.Names {
+						d := &decl{
+							name: n.Name,
+							pos:  n.Pos(),
+							kind: kind,
+							typ:  declString(kind, n.Name, s.Type),
+							doc:  doc,
+							expr: s.Type,
+							file: info,
+						}
+						if s.Type == nil && len(s.Values) == len(s.Names) {
+							d.val = trimValue(s.Values[i])
+						}
+						pkg.decls = append(pkg.decls, d)
+					}
+				case *ast.TypeSpec:
 					pkg.decls = append(pkg.decls, &decl{
-						name: n.Name,
-						doc:  s.Comment.Text(),
+						name: s.Name.Name,
+						pos:  s.Name.Pos(),
+						kind: ast.Typ,
+						typ:  declString(ast.Typ, s.Name.Name, s.Type),
+						doc:  specDoc(d, s.Doc, s.Comment),
+						expr: s.Type,
+						file: info,
 					})
 				}
-			case *ast.TypeSpec:
-				pkg.decls = append(pkg.decls, &decl{
-					name: s.Name.Name,
-					doc:  s.Comment.Text(),
-				})
 			}
 		case *ast.FuncDecl:
-			if d.Recv != nil {
+			fn := funcDecl(d, info)
+			if d.Recv == nil {
+				pkg.decls = append(pkg.decls, fn)
 				continue
 			}
-			pkg.decls = append(pkg.decls, &decl{
-				name: d.Name.Name,
-				doc:  d.Doc.Text(),
-			})
+			if len(d.Recv.List) != 1 {
+				continue
+			}
+			recv, ptr := recvTypeName(d.Recv.List[0].Type)
+			if recv == "" {
+				continue
+			}
+			fn.ptrRecv = ptr
+			if pkg.methods == nil {
+				pkg.methods = make(map[string][]*decl)
+			}
+			pkg.methods[recv] = append(pkg.methods[recv], fn)
 		}
 	}
+
+	pkg.mu.Lock()
+	pkg.names = nil
+	pkg.mu.Unlock()
+}
+
+// trimValue returns the parts of a value expression needed to
+// guess its type, so the index does not hold on to large
+// composite literals like the unicode tables.
+func trimValue(v ast.Expr) ast.Expr {
+	switch v := v.(type) {
+	case *ast.Ident, *ast.SelectorExpr:
+		return v
+	case *ast.ParenExpr:
+		return trimValue(v.X)
+	case *ast.CompositeLit:
+		return &ast.CompositeLit{Type: v.Type}
+	case *ast.UnaryExpr:
+		if x := trimValue(v.X); x != nil {
+			return &ast.UnaryExpr{Op: v.Op, X: x}
+		}
+	case *ast.CallExpr:
+		call := &ast.CallExpr{Fun: v.Fun}
+		if id, ok := v.Fun.(*ast.Ident); ok && (id.Name == "new" || id.Name == "make") && len(v.Args) > 0 {
+			call.Args = v.Args[:1]
+		}
+		return call
+	}
+	return nil
+}
+
+// specDoc returns the doc comment of a spec in d, falling back to
+// the doc comment of d when the spec is alone in it, and then to
+// the line comment.
+func specDoc(d *ast.GenDecl, doc, comment *ast.CommentGroup) string {
+	if doc == nil && len(d.Specs) == 1 {
+		doc = d.Doc
+	}
+	if doc == nil {
+		doc = comment
+	}
+	return doc.Text()
+}
+
+// funcDecl describes a function or method declared in file,
+// which is nil for the queried file.
+func funcDecl(d *ast.FuncDecl, file *fileInfo) *decl {
+	return &decl{
+		name: d.Name.Name,
+		pos:  d.Name.Pos(),
+		kind: ast.Fun,
+		typ:  declString(ast.Fun, d.Name.Name, d.Type),
+		doc:  d.Doc.Text(),
+		expr: d.Type,
+		file: file,
+	}
+}
+
+// recvTypeName returns the name of the type a method is declared
+// on, and whether the method has a pointer receiver.
+func recvTypeName(e ast.Expr) (name string, ptr bool) {
+	if star, ok := e.(*ast.StarExpr); ok {
+		e, ptr = star.X, true
+	}
+	// Strip type parameters, as in func (l *List[T]) Len() int.
+	switch x := e.(type) {
+	case *ast.IndexExpr:
+		e = x.X
+	case *ast.IndexListExpr:
+		e = x.X
+	}
+	if id, ok := e.(*ast.Ident); ok {
+		return id.Name, ptr
+	}
+	return "", false
 }
 
 var fset = token.NewFileSet()
@@ -91,47 +223,53 @@ func SimpleIndexer() *Index {
 	p := new(simpleIndexer)
 
 	p.Lock()
-	p.m = new(Indexer)
+	p.m = &Indexer{Fset: fset}
 	p.Unlock()
 
-	path := filepath.Join(build.Default.GOROOT, "src", "pkg")
-	f, err := os.Open(path)
-	if err != nil {
-		fmt.Fprint(os.Stderr, err)
-		return nil
-	}
-	children, err := f.Readdir(-1)
-	f.Close()
-	if err != nil {
+	if err := p.loadTree(gorootSrc(), ""); err != nil {
 		fmt.Fprint(os.Stderr, err)
 		return nil
 	}
 
-	var wg sync.WaitGroup
-	for _, child := range children {
-		if child.IsDir() {
-			wg.Add(1)
-			go func(path, name string) {
-				defer wg.Done()
-				p.loadPkg(&wg, path, name)
-			}(path, child.Name())
-		}
-	}
-	wg.Wait()
-
 	p.Lock()
 	defer p.Unlock()
 	return p.m.Index()
 }
 
-func (p *simpleIndexer) loadPkg(wg *sync.WaitGroup, root, pkgrelpath string) {
-	importPath := filepath.ToSlash(pkgrelpath)
+// gorootSrc returns the root of the standard library source.
+func gorootSrc() string {
+	src := filepath.Join(build.Default.GOROOT, "src")
+	if fi, err := os.Stat(filepath.Join(src, "pkg")); err == nil && fi.IsDir() {
+		return filepath.Join(src, "pkg") // before Go 1.4
+	}
+	return src
+}
+
+// loadTree indexes the packages in the tree at root, with import
+// paths beginning with prefix. Nested modules are left out.
+func (p *simpleIndexer) loadTree(root, prefix string) error {
+	if _, err := os.Stat(root); err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.loadPkg(&wg, root, prefix, "")
+	}()
+	wg.Wait()
+	return nil
+}
+
+func (p *simpleIndexer) loadPkg(wg *sync.WaitGroup, root, prefix, pkgrelpath string) {
+	dir := filepath.Join(root, pkgrelpath)
+	importPath := filepath.ToSlash(filepath.Join(prefix, pkgrelpath))
 
-	buildPkg, err := build.Import(importPath, "", 0)
+	buildPkg, err := build.Default.ImportDir(dir, 0)
 	if err == nil {
 		for _, fileName := range buildPkg.GoFiles {
-			path := filepath.Join(root, importPath, fileName)
-			f, err := parser.ParseFile(fset, path, nil, parser.ParseComments|parser.AllErrors)
+			path := filepath.Join(dir, fileName)
+			f, err := parser.ParseFile(p.m.Fset, path, nil, parser.ParseComments|parser.AllErrors)
 			if err != nil {
 				continue
 			}
@@ -141,7 +279,6 @@ func (p *simpleIndexer) loadPkg(wg *sync.WaitGroup, root, pkgrelpath string) {
 		}
 	}
 
-	dir := filepath.Join(root, importPath)
 	pkgDir, err := os.Open(dir)
 	if err != nil {
 		return
@@ -153,18 +290,19 @@ func (p *simpleIndexer) loadPkg(wg *sync.WaitGroup, root, pkgrelpath string) {
 	}
 	for _, child := range children {
 		name := child.Name()
-		if name == "" {
+		if name == "" || name == "testdata" || !child.IsDir() {
 			continue
 		}
-		if c := name[0]; c == '.' || ('0' <= c && c <= '9') {
+		if c := name[0]; c == '.' || c == '_' || ('0' <= c && c <= '9') {
 			continue
 		}
-		if child.IsDir() {
-			wg.Add(1)
-			go func(root, name string) {
-				defer wg.Done()
-				p.loadPkg(wg, root, name)
-			}(root, filepath.Join(importPath, name))
+		if _, err := os.Stat(filepath.Join(dir, name, "go.mod")); err == nil {
+			continue // another module
 		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			p.loadPkg(wg, root, prefix, name)
+		}(filepath.Join(pkgrelpath, name))
 	}
 }
@@ -0,0 +1,154 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gofill
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Match scores, best first.
+const (
+	matchPrefix      = 4 // Print for Pri
+	matchFoldPrefix  = 3 // Print for pri
+	matchInitials    = 2 // ListenAndServe for LAS or ListenAS
+	matchSubsequence = 1 // Printf for pf
+)
+
+// match reports how well name matches the pattern typed by the
+// user, and which bytes of name matched, for highlighting.
+// A score of zero means no match.
+//
+// Beyond prefixes, each rune of the pattern may continue the
+// current word of name or begin a later word, so LAS matches
+// ListenAndServe. Failing that, the pattern may be any
+// subsequence of name beginning with its first rune.
+// All but matchPrefix ignore case.
+func match(pattern, name string) (score int, matched []Range) {
+	if pattern == "" {
+		return matchPrefix, nil
+	}
+	if strings.HasPrefix(name, pattern) {
+		return matchPrefix, []Range{{0, len(pattern)}}
+	}
+	if len(name) >= len(pattern) && strings.EqualFold(name[:len(pattern)], pattern) {
+		return matchFoldPrefix, []Range{{0, len(pattern)}}
+	}
+	return matchWords(pattern, name)
+}
+
+// matchWords is match for a name known not to begin with the
+// pattern, which can only match as initials or a subsequence.
+func matchWords(pattern, name string) (score int, matched []Range) {
+	// Word prefixes are a subsequence too, and are more
+	// expensive to look for.
+	sub := subsequence(pattern, name)
+	if sub == nil {
+		return 0, nil
+	}
+	if m := wordPrefixes(pattern, name, 0); m != nil {
+		return matchInitials, m
+	}
+	return matchSubsequence, sub
+}
+
+// wordPrefixes matches pattern against name[i:], where i is the
+// start of a word. Each rune of pattern either continues the
+// current word or starts a new one.
+func wordPrefixes(pattern, name string, i int) []Range {
+	if pattern == "" {
+		return []Range{}
+	}
+	// Match as much of the current word as possible, backing
+	// off until the rest of the pattern matches later words.
+	type split struct{ p, n int }
+	var splits []split
+	p, n := 0, i
+	for p < len(pattern) && n < len(name) && (n == i || !isWordStart(name, n)) {
+		pr, psize := utf8.DecodeRuneInString(pattern[p:])
+		nr, nsize := utf8.DecodeRuneInString(name[n:])
+		if !equalFold(pr, nr) {
+			break
+		}
+		p, n = p+psize, n+nsize
+		splits = append(splits, split{p, n})
+	}
+	for k := len(splits) - 1; k >= 0; k-- {
+		p, n := splits[k].p, splits[k].n
+		if p == len(pattern) {
+			return []Range{{i, n}}
+		}
+		for j := n; j < len(name); j++ {
+			if !isWordStart(name, j) {
+				continue
+			}
+			if m := wordPrefixes(pattern[p:], name, j); m != nil {
+				return append([]Range{{i, n}}, m...)
+			}
+		}
+	}
+	return nil
+}
+
+// subsequence matches the runes of pattern in order
+// against name, which must begin with the first rune.
+func subsequence(pattern, name string) []Range {
+	var res []Range
+	i := 0
+	for _, pr := range pattern {
+		for {
+			if i >= len(name) {
+				return nil
+			}
+			nr, size := utf8.DecodeRuneInString(name[i:])
+			if equalFold(pr, nr) {
+				if len(res) > 0 && res[len(res)-1].End == i {
+					res[len(res)-1].End += size
+				} else if len(res) == 0 && i != 0 {
+					return nil
+				} else {
+					res = append(res, Range{i, i + size})
+				}
+				i += size
+				break
+			}
+			if len(res) == 0 {
+				return nil
+			}
+			i += size
+		}
+	}
+	return res
+}
+
+// isWordStart reports whether a word begins at name[i], as in
+// the camelCase, snake_case or digit-separated name.
+func isWordStart(name string, i int) bool {
+	if i == 0 {
+		return true
+	}
+	prev, _ := utf8.DecodeLastRuneInString(name[:i])
+	r, _ := utf8.DecodeRuneInString(name[i:])
+	switch {
+	case prev == '_':
+		return r != '_'
+	case unicode.IsUpper(r):
+		if !unicode.IsUpper(prev) {
+			return true
+		}
+		// The last capital of an acronym starts the next
+		// word, as in the R of HTTPRequest.
+		next, _ := utf8.DecodeRuneInString(name[i+utf8.RuneLen(r):])
+		return unicode.IsLower(next)
+	case unicode.IsDigit(r):
+		return !unicode.IsDigit(prev)
+	}
+	return false
+}
+
+func equalFold(a, b rune) bool {
+	return unicode.ToLower(a) == unicode.ToLower(b)
+}
@@ -0,0 +1,444 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gofill
+
+import (
+	"bytes"
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ModuleIndexer indexes the standard library, the packages of the
+// module containing dir, or of the modules in its go.work file, and
+// the modules they require. Required modules are read from the
+// module cache, or the directory a replace directive names, and are
+// left out if they have not been downloaded.
+func ModuleIndexer(dir string) (*Index, error) {
+	p := new(simpleIndexer)
+
+	p.Lock()
+	p.m = &Indexer{Fset: fset}
+	p.Unlock()
+
+	if err := p.loadTree(gorootSrc(), ""); err != nil {
+		return nil, err
+	}
+	if err := p.loadModule(dir); err != nil {
+		return nil, err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	return p.m.Index(), nil
+}
+
+// loadModule indexes the workspace containing dir: the modules
+// it is made of and their requirements, as replaced.
+func (p *simpleIndexer) loadModule(dir string) error {
+	ws, err := findWorkspace(dir)
+	if err != nil {
+		return err
+	}
+	for path, root := range ws.modules {
+		p.loadTree(root, path)
+	}
+	cache := modCache()
+	for path, version := range ws.require {
+		if _, ok := ws.modules[path]; ok {
+			continue // the workspace's copy is used
+		}
+		root := filepath.Join(cache, escapeModPath(path)+"@"+escapeModPath(version))
+		if r, ok := ws.replacement(path, version); ok {
+			if r.version == "" {
+				root = r.path // a directory
+			} else {
+				root = filepath.Join(cache, escapeModPath(r.path)+"@"+escapeModPath(r.version))
+			}
+		}
+		// Not in the cache, the module stays unknown.
+		p.loadTree(root, path)
+	}
+	return nil
+}
+
+// A workspace is the set of modules the go command builds with:
+// the module containing a directory, or those a go.work file uses.
+type workspace struct {
+	modules map[string]string // module path -> root directory
+	require map[string]string // module path -> selected version
+	// replace maps a module path, and version if the replacement
+	// is for one version only, to a module or, with no version,
+	// an absolute directory.
+	replace map[modVersion]modVersion
+}
+
+// findWorkspace finds the workspace containing dir. As with the go
+// command, the go.work file may be set by $GOWORK, or disabled by
+// GOWORK=off, and otherwise is looked for in dir and above.
+func findWorkspace(dir string) (*workspace, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	ws := &workspace{
+		modules: make(map[string]string),
+		require: make(map[string]string),
+		replace: make(map[modVersion]modVersion),
+	}
+	workPath := os.Getenv("GOWORK")
+	if workPath == "" {
+		workPath = findUp(dir, "go.work")
+	}
+	if workPath == "" || workPath == "off" {
+		root, mf, err := findModule(dir)
+		if err != nil {
+			return nil, err
+		}
+		ws.add(root, mf)
+		return ws, nil
+	}
+
+	data, err := ioutil.ReadFile(workPath)
+	if err != nil {
+		return nil, err
+	}
+	wf, err := parseWorkFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", workPath, err)
+	}
+	workDir := filepath.Dir(workPath)
+	for _, use := range wf.use {
+		root := use
+		if !filepath.IsAbs(root) {
+			root = filepath.Join(workDir, root)
+		}
+		modPath := filepath.Join(root, "go.mod")
+		data, err := ioutil.ReadFile(modPath)
+		if err != nil {
+			return nil, err
+		}
+		mf, err := parseModFile(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", modPath, err)
+		}
+		ws.add(root, mf)
+	}
+	// Replacements in go.work take precedence.
+	for _, r := range wf.replace {
+		ws.addReplace(workDir, r)
+	}
+	return ws, nil
+}
+
+// add adds the module with its go.mod file in root.
+func (ws *workspace) add(root string, mf *modFile) {
+	ws.modules[mf.module] = root
+	for _, req := range mf.require {
+		// The go command selects the highest version required.
+		if v, ok := ws.require[req.path]; !ok || semverLess(v, req.version) {
+			ws.require[req.path] = req.version
+		}
+	}
+	for _, r := range mf.replace {
+		ws.addReplace(root, r)
+	}
+}
+
+// addReplace adds a replacement from a go.mod or go.work file in dir.
+func (ws *workspace) addReplace(dir string, r modReplace) {
+	if r.new.version == "" && !filepath.IsAbs(r.new.path) {
+		r.new.path = filepath.Join(dir, r.new.path)
+	}
+	ws.replace[r.old] = r.new
+}
+
+// replacement finds the replacement of a module version.
+func (ws *workspace) replacement(path, version string) (modVersion, bool) {
+	if r, ok := ws.replace[modVersion{path, version}]; ok {
+		return r, true
+	}
+	r, ok := ws.replace[modVersion{path, ""}]
+	return r, ok
+}
+
+// findUp finds the file named name in dir or the closest
+// directory above it, returning its path or "".
+func findUp(dir, name string) string {
+	for {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// findModule finds the go.mod file in dir or the closest
+// directory above it.
+func findModule(dir string) (root string, mf *modFile, err error) {
+	path := findUp(dir, "go.mod")
+	if path == "" {
+		return "", nil, fmt.Errorf("no go.mod in %s or above", dir)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if mf, err = parseModFile(data); err != nil {
+		return "", nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return filepath.Dir(path), mf, nil
+}
+
+// modCache returns the module cache directory, $GOMODCACHE or
+// else pkg/mod in the first GOPATH entry.
+func modCache() string {
+	if dir := os.Getenv("GOMODCACHE"); dir != "" {
+		return dir
+	}
+	gopath := filepath.SplitList(build.Default.GOPATH)
+	if len(gopath) == 0 {
+		return ""
+	}
+	return filepath.Join(gopath[0], "pkg", "mod")
+}
+
+// escapeModPath escapes a module path or version as it appears
+// in the module cache, where upper case letters are written as
+// ! and the lower case letter, for case-insensitive file systems.
+func escapeModPath(s string) string {
+	var buf bytes.Buffer
+	for _, r := range s {
+		if 'A' <= r && r <= 'Z' {
+			buf.WriteByte('!')
+			r = unicode.ToLower(r)
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// A modFile is the part of a go.mod file we need.
+type modFile struct {
+	module  string
+	require []modVersion
+	replace []modReplace
+}
+
+// A workFile is the part of a go.work file we need.
+type workFile struct {
+	use     []string // module directories
+	replace []modReplace
+}
+
+type modVersion struct {
+	path    string
+	version string
+}
+
+// A modReplace replaces old, or all its versions if old.version is
+// empty, with new, or with the directory new.path if new.version is
+// empty.
+type modReplace struct {
+	old, new modVersion
+}
+
+// parseModFile reads the module, require and replace directives of
+// a go.mod file.
+func parseModFile(data []byte) (*modFile, error) {
+	mf := new(modFile)
+	err := parseDirectives(data, func(verb string, args []string) error {
+		switch verb {
+		case "module":
+			if len(args) != 1 {
+				return fmt.Errorf("usage: module path")
+			}
+			mf.module = args[0]
+		case "require":
+			if len(args) != 2 {
+				return fmt.Errorf("usage: require module/path v1.2.3")
+			}
+			mf.require = append(mf.require, modVersion{args[0], args[1]})
+		case "replace":
+			r, err := parseReplace(args)
+			if err != nil {
+				return err
+			}
+			mf.replace = append(mf.replace, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if mf.module == "" {
+		return nil, fmt.Errorf("no module directive")
+	}
+	return mf, nil
+}
+
+// parseWorkFile reads the use and replace directives of a go.work
+// file.
+func parseWorkFile(data []byte) (*workFile, error) {
+	wf := new(workFile)
+	err := parseDirectives(data, func(verb string, args []string) error {
+		switch verb {
+		case "use":
+			if len(args) != 1 {
+				return fmt.Errorf("usage: use local/dir")
+			}
+			wf.use = append(wf.use, args[0])
+		case "replace":
+			r, err := parseReplace(args)
+			if err != nil {
+				return err
+			}
+			wf.replace = append(wf.replace, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return wf, nil
+}
+
+// parseReplace parses the arguments of a replace directive,
+// old [version] => new [version].
+func parseReplace(args []string) (modReplace, error) {
+	var r modReplace
+	arrow := -1
+	for i, arg := range args {
+		if arg == "=>" {
+			arrow = i
+		}
+	}
+	old, new := args, []string(nil)
+	if arrow >= 0 {
+		old, new = args[:arrow], args[arrow+1:]
+	}
+	if len(old) < 1 || len(old) > 2 || len(new) < 1 || len(new) > 2 {
+		return r, fmt.Errorf("usage: replace module/path [v1.2.3] => other/module v1.4.5 or local/dir")
+	}
+	r.old.path = old[0]
+	if len(old) == 2 {
+		r.old.version = old[1]
+	}
+	r.new.path = new[0]
+	if len(new) == 2 {
+		r.new.version = new[1]
+	} else if !isDirPath(r.new.path) {
+		return r, fmt.Errorf("replacement module %s without version must be a directory", r.new.path)
+	}
+	return r, nil
+}
+
+// isDirPath reports whether a replacement is a directory rather
+// than a module path.
+func isDirPath(path string) bool {
+	return path == "." || path == ".." ||
+		strings.HasPrefix(path, "./") || strings.HasPrefix(path, "../") ||
+		strings.HasPrefix(path, `.\`) || strings.HasPrefix(path, `..\`) ||
+		filepath.IsAbs(path)
+}
+
+// parseDirectives calls fn with the verb and unquoted arguments of
+// each directive in a go.mod or go.work file, in either the single
+// line or block form.
+func parseDirectives(data []byte, fn func(verb string, args []string) error) error {
+	block := "" // verb of the enclosing ( ) block
+	for i, line := range strings.Split(string(data), "\n") {
+		if j := strings.Index(line, "//"); j >= 0 {
+			line = line[:j]
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		verb := block
+		switch {
+		case block != "" && args[0] == ")":
+			block = ""
+			continue
+		case block == "" && len(args) == 2 && args[1] == "(":
+			block = args[0]
+			continue
+		case block == "":
+			verb, args = args[0], args[1:]
+		}
+		for j, arg := range args {
+			if strings.HasPrefix(arg, `"`) || strings.HasPrefix(arg, "`") {
+				s, err := strconv.Unquote(arg)
+				if err != nil {
+					return fmt.Errorf("line %d: %v", i+1, err)
+				}
+				args[j] = s
+			}
+		}
+		if err := fn(verb, args); err != nil {
+			return fmt.Errorf("line %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// semverLess reports whether the semantic version v is lower
+// than w, as in v1.9.0 < v1.10.0 and v1.0.0-rc.1 < v1.0.0.
+func semverLess(v, w string) bool {
+	vn, vpre := splitSemver(v)
+	wn, wpre := splitSemver(w)
+	for i := range vn {
+		if vn[i] != wn[i] {
+			return vn[i] < wn[i]
+		}
+	}
+	if vpre == "" || wpre == "" {
+		// A release is higher than its prereleases.
+		return vpre != "" && wpre == ""
+	}
+	vids, wids := strings.Split(vpre, "."), strings.Split(wpre, ".")
+	for i := 0; i < len(vids) && i < len(wids); i++ {
+		if vids[i] == wids[i] {
+			continue
+		}
+		vnum, verr := strconv.Atoi(vids[i])
+		wnum, werr := strconv.Atoi(wids[i])
+		switch {
+		case verr == nil && werr == nil:
+			return vnum < wnum
+		case verr == nil || werr == nil:
+			// Numeric identifiers are lower.
+			return verr == nil
+		}
+		return vids[i] < wids[i]
+	}
+	return len(vids) < len(wids)
+}
+
+// splitSemver splits vMAJOR.MINOR.PATCH-PRERELEASE+BUILD into its
+// numbers and prerelease.
+func splitSemver(v string) (nums [3]int, pre string) {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.Index(v, "+"); i >= 0 {
+		v = v[:i]
+	}
+	if i := strings.Index(v, "-"); i >= 0 {
+		v, pre = v[:i], v[i+1:]
+	}
+	for i, n := range strings.SplitN(v, ".", 3) {
+		nums[i], _ = strconv.Atoi(n)
+	}
+	return nums, pre
+}
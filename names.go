@@ -0,0 +1,128 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gofill
+
+import (
+	"bytes"
+	"index/suffixarray"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// A nameIndex finds names by prefix or substring, ignoring case,
+// without scanning them all.
+//
+// The lower cased names are kept sorted, so the names with a
+// prefix are adjacent and found by binary search. For substrings,
+// the sorted names are joined, each preceded by a NUL, into a
+// suffix array.
+type nameIndex struct {
+	names  []string
+	lower  []string // sorted lower cased names
+	order  []int    // order[i] is the index in names of lower[i]
+	starts []int    // offset of each of lower in the joined data
+	sa     *suffixarray.Index
+}
+
+func newNameIndex(names []string) *nameIndex {
+	ix := &nameIndex{
+		names: names,
+		lower: make([]string, len(names)),
+		order: make([]int, len(names)),
+	}
+	for i, name := range names {
+		ix.lower[i] = strings.ToLower(name)
+		ix.order[i] = i
+	}
+	sort.Stable(ix)
+
+	var buf bytes.Buffer
+	ix.starts = make([]int, len(names))
+	for i, name := range ix.lower {
+		buf.WriteByte(0)
+		ix.starts[i] = buf.Len()
+		buf.WriteString(name)
+	}
+	ix.sa = suffixarray.New(buf.Bytes())
+	return ix
+}
+
+func (ix *nameIndex) Len() int           { return len(ix.lower) }
+func (ix *nameIndex) Less(i, j int) bool { return ix.lower[i] < ix.lower[j] }
+func (ix *nameIndex) Swap(i, j int) {
+	ix.lower[i], ix.lower[j] = ix.lower[j], ix.lower[i]
+	ix.order[i], ix.order[j] = ix.order[j], ix.order[i]
+}
+
+// withPrefix returns the indexes of the names beginning with
+// prefix, in order of their lower cased names.
+func (ix *nameIndex) withPrefix(prefix string) []int {
+	i, j := ix.span(prefix)
+	return ix.order[i:j]
+}
+
+// span returns the range of lower holding the names beginning
+// with prefix.
+func (ix *nameIndex) span(prefix string) (i, j int) {
+	prefix = strings.ToLower(prefix)
+	i = sort.SearchStrings(ix.lower, prefix)
+	j = i
+	for j < len(ix.lower) && strings.HasPrefix(ix.lower[j], prefix) {
+		j++
+	}
+	return i, j
+}
+
+// containing returns the indexes of the names containing s,
+// in order of their lower cased names.
+func (ix *nameIndex) containing(s string) []int {
+	if s == "" {
+		return ix.withPrefix("")
+	}
+	if strings.IndexByte(s, 0) >= 0 {
+		return nil
+	}
+	offs := ix.sa.Lookup([]byte(strings.ToLower(s)), -1)
+	seen := make(map[int]bool)
+	var sorted []int
+	for _, off := range offs {
+		// The name starting at or before off.
+		i := sort.SearchInts(ix.starts, off+1) - 1
+		if !seen[i] {
+			seen[i] = true
+			sorted = append(sorted, i)
+		}
+	}
+	sort.Ints(sorted)
+	res := make([]int, len(sorted))
+	for k, i := range sorted {
+		res[k] = ix.order[i]
+	}
+	return res
+}
+
+// candidates returns the indexes of the names that may match
+// pattern. The first n begin with the whole pattern, so may match
+// it as a prefix. The rest only share its first rune, so may only
+// match it as initials or a subsequence.
+func (ix *nameIndex) candidates(pattern string) (idx []int, n int) {
+	lo, hi := ix.span(firstRune(pattern))
+	i, j := ix.span(pattern)
+	if i == lo && j == hi {
+		return ix.order[lo:hi], j - i
+	}
+	idx = make([]int, 0, hi-lo)
+	idx = append(idx, ix.order[i:j]...)
+	idx = append(idx, ix.order[lo:i]...)
+	idx = append(idx, ix.order[j:hi]...)
+	return idx, j - i
+}
+
+// firstRune returns the first rune of s, as a string.
+func firstRune(s string) string {
+	_, size := utf8.DecodeRuneInString(s)
+	return s[:size]
+}
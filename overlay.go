@@ -0,0 +1,256 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gofill
+
+import (
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SetOverlay records the unsaved contents of the file at path.
+// They are used in place of the file on disk, which need not
+// exist, until DropOverlay. The package in the file's directory
+// is indexed again, or for the first time if its import path can
+// be worked out from the packages or go.mod file above it.
+func (x *Index) SetOverlay(path, src string) {
+	path = absPath(path)
+	x.overlayMu.Lock()
+	if x.overlay == nil {
+		x.overlay = make(map[string]string)
+	}
+	x.overlay[path] = src
+	x.overlayMu.Unlock()
+	x.reindex(filepath.Dir(path))
+}
+
+// DropOverlay discards the unsaved contents of the file at path,
+// returning to the file on disk.
+func (x *Index) DropOverlay(path string) {
+	path = absPath(path)
+	x.overlayMu.Lock()
+	_, ok := x.overlay[path]
+	delete(x.overlay, path)
+	x.overlayMu.Unlock()
+	if ok {
+		x.reindex(filepath.Dir(path))
+	}
+}
+
+// source returns the unsaved contents of the file at path, or
+// nil to read it from disk, for parser.ParseFile.
+func (x *Index) source(path string) interface{} {
+	x.overlayMu.Lock()
+	defer x.overlayMu.Unlock()
+	if src, ok := x.overlay[absPath(path)]; ok {
+		return src
+	}
+	return nil
+}
+
+// buildContext returns build.Default reading through the overlay.
+func (x *Index) buildContext() *build.Context {
+	ctxt := build.Default
+	ctxt.OpenFile = x.openFile
+	ctxt.ReadDir = x.readDir
+	ctxt.IsDir = x.isDir
+	return &ctxt
+}
+
+// isDir reports whether dir is a directory on disk, or holds
+// files in the overlay.
+func (x *Index) isDir(dir string) bool {
+	if fi, err := os.Stat(dir); err == nil {
+		return fi.IsDir()
+	}
+	dir = absPath(dir)
+	x.overlayMu.Lock()
+	defer x.overlayMu.Unlock()
+	for path := range x.overlay {
+		if filepath.Dir(path) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+func (x *Index) openFile(path string) (io.ReadCloser, error) {
+	if src, ok := x.source(path).(string); ok {
+		return ioutil.NopCloser(strings.NewReader(src)), nil
+	}
+	return os.Open(path)
+}
+
+// readDir lists dir on disk, with the files in the overlay.
+func (x *Index) readDir(dir string) ([]os.FileInfo, error) {
+	dir = absPath(dir)
+	entries, err := ioutil.ReadDir(dir)
+	x.overlayMu.Lock()
+	defer x.overlayMu.Unlock()
+	byName := make(map[string]os.FileInfo)
+	for _, fi := range entries {
+		byName[fi.Name()] = fi
+	}
+	for path, src := range x.overlay {
+		if filepath.Dir(path) == dir {
+			name := filepath.Base(path)
+			byName[name] = overlayInfo{name, int64(len(src))}
+		}
+	}
+	if err != nil && len(byName) == 0 {
+		return nil, err
+	}
+	var res []os.FileInfo
+	for _, fi := range byName {
+		res = append(res, fi)
+	}
+	sort.Sort(byFileName(res))
+	return res, nil
+}
+
+// reindex indexes the package in dir again, or for the first
+// time if its import path can be worked out, and forgets the type
+// checked packages that may depend on it.
+func (x *Index) reindex(dir string) {
+	x.typesMu.Lock()
+	x.typesPkgs = nil
+	x.typesMu.Unlock()
+
+	x.mu.RLock()
+	var old *pkgDecl
+	for _, pkg := range x.pkgs {
+		if pkg.dir != "" && absPath(pkg.dir) == dir {
+			old = pkg
+			break
+		}
+	}
+	importPath := ""
+	if old != nil {
+		importPath = old.path
+	} else {
+		importPath = x.dirImportPath(dir)
+	}
+	x.mu.RUnlock()
+	if importPath == "" {
+		return
+	}
+
+	indexer := &Indexer{Fset: token.NewFileSet()}
+	bp, _ := x.buildContext().ImportDir(dir, 0)
+	if bp != nil {
+		for _, name := range bp.GoFiles {
+			path := filepath.Join(dir, name)
+			f, _ := parser.ParseFile(indexer.Fset, path, x.source(path), parser.ParseComments)
+			if f != nil {
+				indexer.AddFile(importPath, f)
+			}
+		}
+	}
+	pkg := indexer.pkgs[importPath]
+	if pkg == nil {
+		if old == nil {
+			return
+		}
+		pkg = &pkgDecl{path: old.path, shortName: old.shortName}
+	}
+	pkg.dir = dir
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.pkgs == nil {
+		x.pkgs = make(map[string]*pkgDecl)
+		x.pkgNames = make(map[string]map[string]bool)
+	}
+	x.pkgs[importPath] = pkg
+	if old != nil && pkg.shortName == old.shortName {
+		return
+	}
+	if old != nil {
+		delete(x.pkgNames[old.shortName], importPath)
+		if len(x.pkgNames[old.shortName]) == 0 {
+			delete(x.pkgNames, old.shortName)
+		}
+	}
+	if x.pkgNames[pkg.shortName] == nil {
+		x.pkgNames[pkg.shortName] = make(map[string]bool)
+	}
+	x.pkgNames[pkg.shortName][importPath] = true
+
+	x.namesMu.Lock()
+	x.names = nil
+	x.namesMu.Unlock()
+}
+
+// dirImportPath works out the import path of the unindexed
+// package in dir from the closest indexed package above it, or
+// else the go.mod file of its module. It returns "" if neither
+// is found. x.mu must be held.
+func (x *Index) dirImportPath(dir string) string {
+	var above *pkgDecl
+	aboveDir := ""
+	for _, pkg := range x.pkgs {
+		if pkg.dir == "" {
+			continue
+		}
+		d := absPath(pkg.dir)
+		if len(d) > len(aboveDir) && strings.HasPrefix(dir, d+string(filepath.Separator)) {
+			above, aboveDir = pkg, d
+		}
+	}
+	if above != nil {
+		rel, err := filepath.Rel(aboveDir, dir)
+		if err == nil {
+			return above.path + "/" + filepath.ToSlash(rel)
+		}
+	}
+
+	root, mf, err := findModule(dir)
+	if err != nil {
+		return ""
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return ""
+	}
+	if rel == "." {
+		return mf.module
+	}
+	return mf.module + "/" + filepath.ToSlash(rel)
+}
+
+// absPath cleans path and makes it absolute, so the paths of
+// overlays and indexed packages can be compared.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// overlayInfo describes a file in the overlay to build.Context.
+type overlayInfo struct {
+	name string
+	size int64
+}
+
+func (fi overlayInfo) Name() string       { return fi.name }
+func (fi overlayInfo) Size() int64        { return fi.size }
+func (fi overlayInfo) Mode() os.FileMode  { return 0644 }
+func (fi overlayInfo) ModTime() time.Time { return time.Time{} }
+func (fi overlayInfo) IsDir() bool        { return false }
+func (fi overlayInfo) Sys() interface{}   { return nil }
+
+type byFileName []os.FileInfo
+
+func (s byFileName) Len() int           { return len(s) }
+func (s byFileName) Less(i, j int) bool { return s[i].Name() < s[j].Name() }
+func (s byFileName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
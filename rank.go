@@ -0,0 +1,93 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gofill
+
+import (
+	"go/ast"
+	"go/token"
+)
+
+// Ranking weights. Match quality dominates, so exact prefixes
+// always come first. Then names of a kind that fits where the
+// cursor is, then names declared further in, and last names
+// declared closer to the cursor.
+const (
+	weightMatch = 1000
+	weightKind  = 400
+	weightLevel = 100
+	maxNearby   = 99 // lines from the cursor earning a bonus
+)
+
+// suggest scores s and adds it to the result. match is the
+// score returned by match, level is where the name is declared
+// and declPos its position in the queried file, if it is there.
+func (query *queryState) suggest(s Suggestion, match int, level scopeLevel, declPos token.Pos) {
+	s.Score = match*weightMatch + int(level)*weightLevel
+	if query.fitsKind(s.Kind) {
+		s.Score += weightKind
+	}
+	if query.inFile(declPos) {
+		d := query.fset.Position(query.cursor).Line - query.fset.Position(declPos).Line
+		if d < 0 {
+			d = -d
+		}
+		if d < maxNearby {
+			s.Score += maxNearby - d
+		}
+	}
+	query.res.Suggest = append(query.res.Suggest, s)
+}
+
+// fitsKind reports whether a name of the given Suggestion.Kind
+// can appear at the cursor. Only types and package names fit
+// where a type is expected, and anything but a type usually
+// fits elsewhere.
+func (query *queryState) fitsKind(kind string) bool {
+	if query.wantType {
+		return kind == "type" || kind == "package"
+	}
+	return kind != "type"
+}
+
+// wantType reports whether the expression being completed
+// must be a type, as in var v T or []T.
+func wantType(path []ast.Node) bool {
+	if len(path) < 2 {
+		return false
+	}
+	e, parent := path[0], path[1]
+	if _, ok := parent.(*ast.SelectorExpr); ok && len(path) > 2 {
+		e, parent = parent, path[2]
+	}
+	switch p := parent.(type) {
+	case *ast.Field:
+		return p.Type == e
+	case *ast.ValueSpec:
+		return p.Type == e
+	case *ast.TypeSpec:
+		return p.Type == e
+	case *ast.CompositeLit:
+		return p.Type == e
+	case *ast.TypeAssertExpr:
+		return p.Type == e
+	case *ast.ArrayType:
+		return p.Elt == e
+	case *ast.MapType, *ast.ChanType:
+		return true
+	}
+	return false
+}
+
+// byScore sorts the best suggestions first, then by name.
+type byScore []Suggestion
+
+func (s byScore) Len() int      { return len(s) }
+func (s byScore) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byScore) Less(i, j int) bool {
+	if s[i].Score != s[j].Score {
+		return s[i].Score > s[j].Score
+	}
+	return s[i].Name < s[j].Name
+}
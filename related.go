@@ -0,0 +1,448 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gofill
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sort"
+
+	"code.google.com/p/go.tools/astutil"
+)
+
+// related finds the identifiers in the file referring to the
+// same declaration as the identifier at the cursor.
+func (x *Index) related(query *queryState) {
+	id, path := query.identAt()
+	if id == nil {
+		return
+	}
+	if query.info != nil {
+		if obj := identObj(query.info, id); obj != nil && !typeCaseVar(query.info, obj) {
+			ast.Inspect(query.f, func(n ast.Node) bool {
+				if id, ok := n.(*ast.Ident); ok && identObj(query.info, id) == obj {
+					query.res.Related = append(query.res.Related, query.rangeOf(id))
+				}
+				return true
+			})
+			return
+		}
+	}
+
+	if !isScopeRef(path) {
+		return
+	}
+	obj, ok := lookupScope(x.pkgs, path)
+	if !ok || !obj.declPos.IsValid() {
+		return
+	}
+	w := &refWalker{name: id.Name, target: obj.declPos, top: true}
+	if obj.level <= levelPackage {
+		// In scope throughout the file.
+		w.decl = obj.declPos
+		w.walk(query.f)
+	} else {
+		// Local to the top-level declaration around it.
+		w.walk(path[len(path)-2])
+	}
+	sort.Sort(byPos(w.refs))
+	for _, ref := range w.refs {
+		query.res.Related = append(query.res.Related, query.rangeOf(ref))
+	}
+}
+
+// A refWalker finds the identifiers referring to or declaring
+// target, a declaration of name, in one pass. It follows the
+// scope rules of scopeOf, tracking which declaration of name is
+// in effect as it goes.
+type refWalker struct {
+	name   string
+	target token.Pos
+	decl   token.Pos // declaration of name in effect
+	top    bool      // at the top level of the file, where order does not matter
+	refs   []*ast.Ident
+}
+
+// declare records a declaration of id, which is in effect from
+// now to the end of the enclosing scope.
+func (w *refWalker) declare(id *ast.Ident) {
+	if id.Name != w.name {
+		return
+	}
+	if id.Pos() == w.target {
+		w.refs = append(w.refs, id)
+	}
+	if !w.top {
+		w.decl = id.Pos()
+	}
+}
+
+// scoped calls fn, forgetting the declarations it makes after.
+func (w *refWalker) scoped(fn func()) {
+	decl, top := w.decl, w.top
+	fn()
+	w.decl, w.top = decl, top
+}
+
+// fieldTypes walks the types of fields, but not their names.
+func (w *refWalker) fieldTypes(fields *ast.FieldList) {
+	if fields == nil {
+		return
+	}
+	for _, f := range fields.List {
+		w.walk(f.Type)
+	}
+}
+
+// declareFields declares the names of fields.
+func (w *refWalker) declareFields(fields *ast.FieldList) {
+	if fields == nil {
+		return
+	}
+	for _, f := range fields.List {
+		for _, id := range f.Names {
+			w.declare(id)
+		}
+	}
+}
+
+// function walks a function with its receiver and signature.
+func (w *refWalker) function(recv *ast.FieldList, ft *ast.FuncType, body *ast.BlockStmt) {
+	w.scoped(func() {
+		w.top = false
+		if recv != nil && len(recv.List) == 1 {
+			// Type parameters of a generic receiver, as T
+			// in func (l *List[T]) Len() int.
+			e := recv.List[0].Type
+			if star, ok := e.(*ast.StarExpr); ok {
+				e = star.X
+			}
+			switch e := e.(type) {
+			case *ast.IndexExpr:
+				w.walk(e.X)
+				w.declareTypeParams([]ast.Expr{e.Index})
+			case *ast.IndexListExpr:
+				w.walk(e.X)
+				w.declareTypeParams(e.Indices)
+			default:
+				w.walk(e)
+			}
+		}
+		w.declareFields(ft.TypeParams)
+		w.fieldTypes(ft.TypeParams)
+		w.fieldTypes(ft.Params)
+		w.fieldTypes(ft.Results)
+		w.declareFields(recv)
+		w.declareFields(ft.Params)
+		w.declareFields(ft.Results)
+		if body != nil {
+			w.walk(body)
+		}
+	})
+}
+
+func (w *refWalker) declareTypeParams(params []ast.Expr) {
+	for _, p := range params {
+		if id, ok := p.(*ast.Ident); ok {
+			w.declare(id)
+		}
+	}
+}
+
+func (w *refWalker) genDecl(d *ast.GenDecl) {
+	for _, spec := range d.Specs {
+		switch spec := spec.(type) {
+		case *ast.ImportSpec:
+			if spec.Name != nil {
+				w.declare(spec.Name)
+			}
+		case *ast.ValueSpec:
+			if spec.Type != nil {
+				w.walk(spec.Type)
+			}
+			for _, v := range spec.Values {
+				w.walk(v)
+			}
+			for _, id := range spec.Names {
+				w.declare(id)
+			}
+		case *ast.TypeSpec:
+			w.declare(spec.Name)
+			w.scoped(func() {
+				w.top = false
+				w.declareFields(spec.TypeParams)
+				w.fieldTypes(spec.TypeParams)
+				w.walk(spec.Type)
+			})
+		}
+	}
+}
+
+func (w *refWalker) walk(node ast.Node) {
+	ast.Inspect(node, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.Ident:
+			if n.Name == w.name && w.decl == w.target {
+				w.refs = append(w.refs, n)
+			}
+		case *ast.File:
+			for _, d := range n.Decls {
+				w.walk(d)
+			}
+			return false
+		case *ast.FuncDecl:
+			if n.Recv == nil {
+				w.declare(n.Name)
+			}
+			w.function(n.Recv, n.Type, n.Body)
+			return false
+		case *ast.FuncLit:
+			w.function(nil, n.Type, n.Body)
+			return false
+		case *ast.GenDecl:
+			w.genDecl(n)
+			return false
+
+		// Names that are not in scope: fields, methods,
+		// parameters of function types, and labels.
+		case *ast.SelectorExpr:
+			w.walk(n.X)
+			return false
+		case *ast.CompositeLit:
+			if n.Type != nil {
+				w.walk(n.Type)
+			}
+			for _, elt := range n.Elts {
+				if kv, ok := elt.(*ast.KeyValueExpr); ok {
+					if _, ok := kv.Key.(*ast.Ident); ok {
+						// Probably a field name.
+						w.walk(kv.Value)
+						continue
+					}
+				}
+				w.walk(elt)
+			}
+			return false
+		case *ast.StructType:
+			w.fieldTypes(n.Fields)
+			return false
+		case *ast.InterfaceType:
+			w.fieldTypes(n.Methods)
+			return false
+		case *ast.FuncType:
+			w.fieldTypes(n.TypeParams)
+			w.fieldTypes(n.Params)
+			w.fieldTypes(n.Results)
+			return false
+		case *ast.LabeledStmt:
+			w.walk(n.Stmt)
+			return false
+		case *ast.BranchStmt:
+			return false
+
+		// Statements declaring names.
+		case *ast.AssignStmt:
+			for _, e := range n.Rhs {
+				w.walk(e)
+			}
+			for _, e := range n.Lhs {
+				if id, ok := e.(*ast.Ident); ok && n.Tok == token.DEFINE {
+					w.declare(id)
+				} else {
+					w.walk(e)
+				}
+			}
+			return false
+		case *ast.RangeStmt:
+			w.walk(n.X)
+			w.scoped(func() {
+				for _, e := range []ast.Expr{n.Key, n.Value} {
+					if id, ok := e.(*ast.Ident); ok && n.Tok == token.DEFINE {
+						w.declare(id)
+					} else if e != nil {
+						w.walk(e)
+					}
+				}
+				w.walk(n.Body)
+			})
+			return false
+		case *ast.TypeSwitchStmt:
+			w.scoped(func() {
+				if n.Init != nil {
+					w.walk(n.Init)
+				}
+				var v *ast.Ident // as in switch v := x.(type)
+				if s, ok := n.Assign.(*ast.AssignStmt); ok && len(s.Lhs) == 1 {
+					v, _ = s.Lhs[0].(*ast.Ident)
+					for _, e := range s.Rhs {
+						w.walk(e)
+					}
+				} else if n.Assign != nil {
+					w.walk(n.Assign)
+				}
+				if v != nil && v.Name == w.name && v.Pos() == w.target {
+					w.refs = append(w.refs, v)
+				}
+				for _, c := range n.Body.List {
+					c := c.(*ast.CaseClause)
+					w.scoped(func() {
+						for _, e := range c.List {
+							w.walk(e)
+						}
+						if v != nil && v.Name == w.name {
+							w.decl = v.Pos()
+						}
+						for _, s := range c.Body {
+							w.walk(s)
+						}
+					})
+				}
+			})
+			return false
+
+		// Statements opening scopes.
+		case *ast.BlockStmt, *ast.IfStmt, *ast.ForStmt, *ast.SwitchStmt,
+			*ast.CaseClause, *ast.CommClause:
+			w.scoped(func() {
+				for _, c := range children(n) {
+					w.walk(c)
+				}
+			})
+			return false
+		}
+		return true
+	})
+}
+
+// children returns the non-nil children of a statement opening
+// a scope, in order.
+func children(n ast.Node) []ast.Node {
+	var res []ast.Node
+	switch n := n.(type) {
+	case *ast.BlockStmt:
+		for _, s := range n.List {
+			res = append(res, s)
+		}
+	case *ast.IfStmt:
+		if n.Init != nil {
+			res = append(res, n.Init)
+		}
+		if n.Cond != nil {
+			res = append(res, n.Cond)
+		}
+		res = append(res, n.Body)
+		if n.Else != nil {
+			res = append(res, n.Else)
+		}
+	case *ast.ForStmt:
+		if n.Init != nil {
+			res = append(res, n.Init)
+		}
+		if n.Cond != nil {
+			res = append(res, n.Cond)
+		}
+		if n.Post != nil {
+			res = append(res, n.Post)
+		}
+		res = append(res, n.Body)
+	case *ast.SwitchStmt:
+		if n.Init != nil {
+			res = append(res, n.Init)
+		}
+		if n.Tag != nil {
+			res = append(res, n.Tag)
+		}
+		res = append(res, n.Body)
+	case *ast.CaseClause:
+		for _, e := range n.List {
+			res = append(res, e)
+		}
+		for _, s := range n.Body {
+			res = append(res, s)
+		}
+	case *ast.CommClause:
+		if n.Comm != nil {
+			res = append(res, n.Comm)
+		}
+		for _, s := range n.Body {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+type byPos []*ast.Ident
+
+func (s byPos) Len() int           { return len(s) }
+func (s byPos) Less(i, j int) bool { return s[i].Pos() < s[j].Pos() }
+func (s byPos) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// identAt finds the identifier at the cursor, which may be
+// just after the identifier or inside it, and its path.
+func (query *queryState) identAt() (*ast.Ident, []ast.Node) {
+	for _, p := range []token.Pos{query.cursor - 1, query.cursor} {
+		path, _ := astutil.PathEnclosingInterval(query.f, p, p+1)
+		if id, ok := path[0].(*ast.Ident); ok {
+			return id, path
+		}
+	}
+	return nil, nil
+}
+
+// typeCaseVar reports whether obj is the variable of a type switch
+// in one of its clauses, where go/types declares it separately.
+func typeCaseVar(info *types.Info, obj types.Object) bool {
+	for n, implicit := range info.Implicits {
+		if _, ok := n.(*ast.CaseClause); ok && implicit == obj {
+			return true
+		}
+	}
+	return false
+}
+
+func identObj(info *types.Info, id *ast.Ident) types.Object {
+	if obj := info.Uses[id]; obj != nil {
+		return obj
+	}
+	return info.Defs[id]
+}
+
+// isScopeRef reports whether the identifier at the end of path
+// names something in scope, rather than a field, method, label
+// or package clause.
+func isScopeRef(path []ast.Node) bool {
+	if len(path) < 2 {
+		return false
+	}
+	id, ok := path[0].(*ast.Ident)
+	if !ok {
+		return false
+	}
+	switch p := path[1].(type) {
+	case *ast.SelectorExpr:
+		return p.Sel != id
+	case *ast.KeyValueExpr:
+		// Probably a field name.
+		if p.Key != id || len(path) < 3 {
+			return true
+		}
+		_, lit := path[2].(*ast.CompositeLit)
+		return !lit
+	case *ast.Field:
+		if p.Type == id || len(path) < 4 {
+			return true
+		}
+		switch path[3].(type) {
+		case *ast.StructType, *ast.InterfaceType:
+			return false
+		}
+	case *ast.FuncDecl:
+		return p.Recv == nil || p.Name != id
+	case *ast.LabeledStmt, *ast.BranchStmt, *ast.File:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,563 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gofill
+
+import (
+	"go/ast"
+	"go/token"
+)
+
+// maxTypeDepth bounds how far we follow named types and
+// embedded fields, guarding against cycles like type T *T.
+const maxTypeDepth = 10
+
+// typeExpr is a syntactic type expression. Identifiers in expr
+// are resolved in file, or in the query scope if file is nil.
+type typeExpr struct {
+	expr ast.Expr
+	file *fileInfo
+}
+
+// maxExprDepth bounds the recursion of exprType, guarding
+// against cycles like x := x.next.
+const maxExprDepth = 50
+
+// objType reports the type of a variable in the query scope.
+func (x *Index) objType(query *queryState, obj scopeObj) typeExpr {
+	if obj.typ != nil {
+		return typeExpr{expr: obj.typ}
+	}
+	if obj.ranged {
+		return x.rangeType(query, obj.val, obj.valIndex)
+	}
+	if call, ok := obj.val.(*ast.CallExpr); ok {
+		return x.resultType(query, call, nil, obj.valIndex)
+	}
+	if obj.valIndex > 0 {
+		// The second value of v, ok := m[k] and friends.
+		return typeExpr{}
+	}
+	return x.exprType(query, obj.val, nil)
+}
+
+// lookup finds the object in the query scope that name refers
+// to at pos, skipping locals that come into scope later, as the
+// second x in x := x.next does.
+func (query *queryState) lookup(name string, pos token.Pos) (scopeObj, bool) {
+	obj, ok := query.scope[name]
+	for ok && pos.IsValid() && obj.start > pos {
+		if obj.outer == nil {
+			return scopeObj{}, false
+		}
+		obj = *obj.outer
+	}
+	return obj, ok
+}
+
+// declType reports the type of a package-level var, const or
+// func, or the type of a field or method.
+func (x *Index) declType(query *queryState, d *decl) typeExpr {
+	if d.expr == nil && d.val != nil {
+		return x.exprType(query, d.val, d.file)
+	}
+	return typeExpr{expr: d.expr, file: d.file}
+}
+
+// exprType guesses the type of a value expression from its
+// syntax alone, e.g. T{} is a T and &T{} is a *T. Identifiers
+// are resolved in file, or in the query scope if file is nil.
+func (x *Index) exprType(query *queryState, e ast.Expr, file *fileInfo) typeExpr {
+	query.depth++
+	defer func() { query.depth-- }()
+	if query.depth > maxExprDepth {
+		return typeExpr{}
+	}
+
+	switch e := e.(type) {
+	case *ast.ParenExpr:
+		return x.exprType(query, e.X, file)
+	case *ast.BasicLit:
+		// The default type of an untyped constant.
+		switch e.Kind {
+		case token.INT:
+			return typeExpr{expr: ast.NewIdent("int")}
+		case token.FLOAT:
+			return typeExpr{expr: ast.NewIdent("float64")}
+		case token.IMAG:
+			return typeExpr{expr: ast.NewIdent("complex128")}
+		case token.CHAR:
+			return typeExpr{expr: ast.NewIdent("rune")}
+		case token.STRING:
+			return typeExpr{expr: ast.NewIdent("string")}
+		}
+	case *ast.Ident:
+		var d *decl
+		if file == nil {
+			if obj, ok := query.lookup(e.Name, e.Pos()); ok {
+				if obj.kind == ast.Typ || obj.kind == ast.Pkg {
+					return typeExpr{}
+				}
+				return x.objType(query, obj)
+			}
+			d = query.localDecl(e.Name)
+		} else {
+			d = file.pkg.lookup(e.Name)
+		}
+		if d == nil || d.kind == ast.Typ {
+			return typeExpr{}
+		}
+		return x.declType(query, d)
+	case *ast.SelectorExpr:
+		if id, ok := e.X.(*ast.Ident); ok {
+			if pkg := x.importedPkg(query, file, id.Name); pkg != nil {
+				d := pkg.lookup(e.Sel.Name)
+				if d == nil || d.kind == ast.Typ {
+					return typeExpr{}
+				}
+				return x.declType(query, d)
+			}
+		}
+		for _, m := range x.members(query, x.exprType(query, e.X, file)) {
+			if m.name == e.Sel.Name {
+				return x.declType(query, m)
+			}
+		}
+	case *ast.CallExpr:
+		return x.resultType(query, e, file, 0)
+	case *ast.CompositeLit:
+		return typeExpr{expr: e.Type, file: file}
+	case *ast.FuncLit:
+		return typeExpr{expr: e.Type, file: file}
+	case *ast.UnaryExpr:
+		switch e.Op {
+		case token.AND:
+			t := x.exprType(query, e.X, file)
+			if t.expr == nil {
+				return typeExpr{}
+			}
+			return typeExpr{expr: &ast.StarExpr{X: t.expr}, file: t.file}
+		case token.ARROW:
+			t := x.underlying(query, x.exprType(query, e.X, file))
+			if ch, ok := t.expr.(*ast.ChanType); ok {
+				return typeExpr{expr: ch.Value, file: t.file}
+			}
+		}
+	case *ast.StarExpr:
+		t := x.underlying(query, x.exprType(query, e.X, file))
+		if star, ok := t.expr.(*ast.StarExpr); ok {
+			return typeExpr{expr: star.X, file: t.file}
+		}
+	case *ast.IndexExpr:
+		t := x.underlying(query, x.exprType(query, e.X, file))
+		if star, ok := t.expr.(*ast.StarExpr); ok {
+			// Indexing a pointer to an array.
+			t = x.underlying(query, typeExpr{expr: star.X, file: t.file})
+		}
+		switch u := t.expr.(type) {
+		case *ast.ArrayType:
+			return typeExpr{expr: u.Elt, file: t.file}
+		case *ast.MapType:
+			return typeExpr{expr: u.Value, file: t.file}
+		}
+	case *ast.SliceExpr:
+		return x.exprType(query, e.X, file)
+	case *ast.TypeAssertExpr:
+		if e.Type != nil {
+			return typeExpr{expr: e.Type, file: file}
+		}
+	}
+	return typeExpr{}
+}
+
+// rangeType reports the type of the key (i == 0) or value
+// (i == 1) of a range clause over e.
+func (x *Index) rangeType(query *queryState, e ast.Expr, i int) typeExpr {
+	t := x.exprType(query, e, nil)
+	u := x.underlying(query, t)
+	if star, ok := u.expr.(*ast.StarExpr); ok {
+		// Ranging over a pointer to an array.
+		u = x.underlying(query, typeExpr{expr: star.X, file: u.file})
+	}
+	switch ut := u.expr.(type) {
+	case *ast.ArrayType:
+		if i == 0 {
+			return typeExpr{expr: ast.NewIdent("int")}
+		}
+		return typeExpr{expr: ut.Elt, file: u.file}
+	case *ast.MapType:
+		if i == 0 {
+			return typeExpr{expr: ut.Key, file: u.file}
+		}
+		return typeExpr{expr: ut.Value, file: u.file}
+	case *ast.ChanType:
+		if i == 0 {
+			return typeExpr{expr: ut.Value, file: u.file}
+		}
+	case nil:
+		// A predeclared type: a string, or an integer as in
+		// for i := range 10.
+		id, ok := t.expr.(*ast.Ident)
+		switch {
+		case !ok:
+		case id.Name == "string" && i == 0:
+			return typeExpr{expr: ast.NewIdent("int")}
+		case id.Name == "string":
+			return typeExpr{expr: ast.NewIdent("rune")}
+		case i == 0:
+			return t
+		}
+	}
+	return typeExpr{}
+}
+
+// resultType reports the type of the i'th result of a call.
+func (x *Index) resultType(query *queryState, call *ast.CallExpr, file *fileInfo, i int) typeExpr {
+	if id, ok := call.Fun.(*ast.Ident); ok && x.isBuiltin(query, file, id.Name) {
+		switch {
+		case id.Name == "new" && len(call.Args) == 1 && i == 0:
+			return typeExpr{expr: &ast.StarExpr{X: call.Args[0]}, file: file}
+		case id.Name == "make" && len(call.Args) > 0 && i == 0:
+			return typeExpr{expr: call.Args[0], file: file}
+		}
+		return typeExpr{}
+	}
+	if file == nil && i == 0 {
+		// Conversion, T(v).
+		if t, ok := x.typeOperand(query, call.Fun); ok {
+			return t
+		}
+	}
+
+	t := x.underlying(query, x.exprType(query, call.Fun, file))
+	fn, ok := t.expr.(*ast.FuncType)
+	if !ok || fn.Results == nil {
+		return typeExpr{}
+	}
+	n := 0
+	for _, field := range fn.Results.List {
+		if len(field.Names) == 0 {
+			n++
+		} else {
+			n += len(field.Names)
+		}
+		if i < n {
+			return typeExpr{expr: field.Type, file: t.file}
+		}
+	}
+	return typeExpr{}
+}
+
+func (x *Index) isBuiltin(query *queryState, file *fileInfo, name string) bool {
+	if file == nil {
+		_, ok := query.scope[name]
+		return !ok && query.localDecl(name) == nil
+	}
+	return file.pkg.lookup(name) == nil
+}
+
+// typeOperand reports whether e denotes a type, as the operand
+// of a method expression like (*T).Method or pkg.T.Method does.
+func (x *Index) typeOperand(query *queryState, e ast.Expr) (typeExpr, bool) {
+	switch e := e.(type) {
+	case *ast.ParenExpr:
+		return x.typeOperand(query, e.X)
+	case *ast.StarExpr:
+		if _, ok := x.typeOperand(query, e.X); ok {
+			return typeExpr{expr: e}, true
+		}
+	case *ast.Ident:
+		obj, ok := query.scope[e.Name]
+		if ok && obj.kind == ast.Typ {
+			return typeExpr{expr: e}, true
+		}
+		if d := query.localDecl(e.Name); !ok && d != nil && d.kind == ast.Typ {
+			return typeExpr{expr: e, file: d.file}, true
+		}
+	case *ast.SelectorExpr:
+		t := typeExpr{expr: e}
+		if x.typeDecl(query, t) != nil {
+			return t, true
+		}
+	}
+	return typeExpr{}, false
+}
+
+// importedPkg finds the package imported under name.
+func (x *Index) importedPkg(query *queryState, file *fileInfo, name string) *pkgDecl {
+	if file == nil {
+		if obj, ok := query.scope[name]; ok {
+			if obj.kind == ast.Pkg {
+				return obj.pkg
+			}
+			return nil
+		}
+		// Not imported.
+		if path := x.inferImport(query, name); path != "" {
+			return x.pkgs[path]
+		}
+		return nil
+	}
+	for _, imp := range file.imports {
+		pkg := x.pkgs[imp.path]
+		if pkg == nil {
+			continue
+		}
+		if imp.name == name || imp.name == "" && pkg.shortName == name {
+			return pkg
+		}
+	}
+	return nil
+}
+
+// typeDecl finds the declaration of a named type in an indexed
+// package. It returns nil for types declared in the queried file.
+func (x *Index) typeDecl(query *queryState, t typeExpr) *decl {
+	var d *decl
+	switch e := t.expr.(type) {
+	case *ast.Ident:
+		if t.file != nil {
+			d = t.file.pkg.lookup(e.Name)
+		} else if _, ok := query.scope[e.Name]; !ok {
+			d = query.localDecl(e.Name)
+		}
+	case *ast.SelectorExpr:
+		id, ok := e.X.(*ast.Ident)
+		if !ok {
+			return nil
+		}
+		pkg := x.importedPkg(query, t.file, id.Name)
+		if pkg == nil {
+			return nil
+		}
+		d = pkg.lookup(e.Sel.Name)
+	}
+	if d == nil || d.kind != ast.Typ {
+		return nil
+	}
+	return d
+}
+
+// namedType finds the declaration of a named type and returns
+// the type expression it is defined as.
+func (x *Index) namedType(query *queryState, t typeExpr) (typeExpr, bool) {
+	if id, ok := t.expr.(*ast.Ident); ok && t.file == nil {
+		if obj, ok := query.scope[id.Name]; ok {
+			if obj.kind != ast.Typ || obj.typ == nil {
+				return typeExpr{}, false
+			}
+			return typeExpr{expr: obj.typ}, true
+		}
+		// Declared in a sibling file, if anywhere.
+	}
+	d := x.typeDecl(query, t)
+	if d == nil {
+		return typeExpr{}, false
+	}
+	return typeExpr{expr: d.expr, file: d.file}, true
+}
+
+// underlying follows named types until it reaches a type literal.
+func (x *Index) underlying(query *queryState, t typeExpr) typeExpr {
+	for i := 0; i < maxTypeDepth; i++ {
+		switch e := t.expr.(type) {
+		case nil:
+			return t
+		case *ast.ParenExpr:
+			t.expr = e.X
+		case *ast.Ident, *ast.SelectorExpr:
+			next, ok := x.namedType(query, t)
+			if !ok {
+				return typeExpr{}
+			}
+			t = next
+		default:
+			return t
+		}
+	}
+	return typeExpr{}
+}
+
+// fields returns the fields selectable on a value of type t,
+// including those promoted from embedded fields.
+func (x *Index) fields(query *queryState, t typeExpr) []*decl {
+	return x.fieldsDepth(query, t, 0)
+}
+
+func (x *Index) fieldsDepth(query *queryState, t typeExpr, depth int) []*decl {
+	if depth > maxTypeDepth {
+		return nil
+	}
+	t = x.underlying(query, t)
+	if star, ok := t.expr.(*ast.StarExpr); ok {
+		t = x.underlying(query, typeExpr{expr: star.X, file: t.file})
+	}
+	st, ok := t.expr.(*ast.StructType)
+	if !ok {
+		return nil
+	}
+
+	var res, promoted []*decl
+	seen := make(map[string]bool)
+	for _, field := range st.Fields.List {
+		doc := field.Doc.Text()
+		if doc == "" {
+			doc = field.Comment.Text()
+		}
+		names := field.Names
+		if len(names) == 0 {
+			// Embedded field, named after its type.
+			if name := embeddedName(field.Type); name != nil {
+				names = []*ast.Ident{name}
+			}
+			embedded := typeExpr{expr: field.Type, file: t.file}
+			promoted = append(promoted, x.fieldsDepth(query, embedded, depth+1)...)
+		}
+		for _, name := range names {
+			seen[name.Name] = true
+			if !query.visible(t.file, name.Name) {
+				continue
+			}
+			res = append(res, &decl{
+				name: name.Name,
+				pos:  name.Pos(),
+				kind: ast.Var,
+				typ:  declString(ast.Var, name.Name, field.Type),
+				doc:  doc,
+				expr: field.Type,
+				file: t.file,
+			})
+		}
+	}
+	// Fields at a shallower depth shadow promoted fields.
+	for _, d := range promoted {
+		if !seen[d.name] {
+			seen[d.name] = true
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+// methods returns the method set of type t. Pointer receiver
+// methods are included if ptr is set, or t is a pointer type.
+func (x *Index) methods(query *queryState, t typeExpr, ptr bool) []*decl {
+	return x.methodsDepth(query, t, ptr, 0)
+}
+
+func (x *Index) methodsDepth(query *queryState, t typeExpr, ptr bool, depth int) []*decl {
+	if depth > maxTypeDepth {
+		return nil
+	}
+	if star, ok := t.expr.(*ast.StarExpr); ok {
+		t.expr, ptr = star.X, true
+	}
+
+	// Methods declared in the queried file and its siblings
+	// belong to types declared in either.
+	var methods []*decl
+	if d := x.typeDecl(query, t); d != nil {
+		if d.file.pkg == query.local {
+			methods = query.localMethods(d.name)
+		}
+		methods = append(methods, d.file.pkg.methods[d.name]...)
+	} else if id, ok := t.expr.(*ast.Ident); ok && t.file == nil {
+		if obj, ok := query.scope[id.Name]; ok && obj.kind == ast.Typ && obj.level == levelPackage {
+			methods = query.localMethods(id.Name)
+			if query.local != nil {
+				methods = append(methods, query.local.methods[id.Name]...)
+			}
+		}
+	}
+	var res []*decl
+	for _, m := range methods {
+		if m.ptrRecv && !ptr || !query.visible(m.file, m.name) {
+			continue
+		}
+		res = append(res, m)
+	}
+
+	u := x.underlying(query, t)
+	switch e := u.expr.(type) {
+	case *ast.InterfaceType:
+		for _, field := range e.Methods.List {
+			if len(field.Names) == 0 {
+				embedded := typeExpr{expr: field.Type, file: u.file}
+				res = append(res, x.methodsDepth(query, embedded, false, depth+1)...)
+				continue
+			}
+			for _, name := range field.Names {
+				if !query.visible(u.file, name.Name) {
+					continue
+				}
+				res = append(res, &decl{
+					name: name.Name,
+					pos:  name.Pos(),
+					kind: ast.Fun,
+					typ:  declString(ast.Fun, name.Name, field.Type),
+					doc:  field.Doc.Text(),
+					expr: field.Type,
+					file: u.file,
+				})
+			}
+		}
+	case *ast.StructType:
+		for _, field := range e.Fields.List {
+			if len(field.Names) == 0 {
+				embedded := typeExpr{expr: field.Type, file: u.file}
+				res = append(res, x.methodsDepth(query, embedded, ptr, depth+1)...)
+			}
+		}
+	}
+	return res
+}
+
+// members returns the fields and methods selectable on an
+// addressable value of type t.
+func (x *Index) members(query *queryState, t typeExpr) []*decl {
+	var res []*decl
+	seen := make(map[string]bool)
+	for _, d := range append(x.fields(query, t), x.methods(query, t, true)...) {
+		if !seen[d.name] {
+			seen[d.name] = true
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+// localMethods returns the methods declared in the queried
+// file on the type named recv.
+func (query *queryState) localMethods(recv string) []*decl {
+	var res []*decl
+	for _, d := range query.f.Decls {
+		fd, ok := d.(*ast.FuncDecl)
+		if !ok || fd.Recv == nil || len(fd.Recv.List) != 1 {
+			continue
+		}
+		name, ptr := recvTypeName(fd.Recv.List[0].Type)
+		if name != recv {
+			continue
+		}
+		m := funcDecl(fd, nil)
+		m.ptrRecv = ptr
+		res = append(res, m)
+	}
+	return res
+}
+
+// embeddedName returns the field name of an embedded type:
+// T, *T, pkg.T and *pkg.T are all named T.
+func embeddedName(e ast.Expr) *ast.Ident {
+	if star, ok := e.(*ast.StarExpr); ok {
+		e = star.X
+	}
+	switch e := e.(type) {
+	case *ast.Ident:
+		return e
+	case *ast.SelectorExpr:
+		return e.Sel
+	}
+	return nil
+}
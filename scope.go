@@ -7,38 +7,221 @@ package gofill
 import (
 	"go/ast"
 	"go/token"
+	"go/types"
 	"strconv"
 )
 
 type scopeObj struct {
 	name string
 	kind ast.ObjKind
-	pkg *pkgDecl
-	// TODO declPos int
+	pkg  *pkgDecl
+	typ  ast.Expr // declared type, or the definition of a type
+	val  ast.Expr // initial value, when typ is unknown
+	// valIndex is the index of the value in a multi-valued val,
+	// as in v, err := f().
+	valIndex int
+	// ranged is set for the key and value of a range clause,
+	// where val is ranged over and valIndex is 0 or 1.
+	ranged  bool
+	level   scopeLevel
+	declPos token.Pos
+	// start is where a local comes into scope, as the end of
+	// x := x.next. It is invalid for names in scope throughout.
+	start token.Pos
+	// outer is the declaration of the same name this one shadows.
+	outer *scopeObj
+}
+
+// A scopeLevel is how far out a name is declared.
+type scopeLevel int
+
+const (
+	levelImported scopeLevel = iota // an import, or declared in another package
+	levelPackage
+	levelParam
+	levelLocal
+)
+
+// scopeObjString renders the type of a scope object,
+// in the style of declString.
+func (x *Index) scopeObjString(query *queryState, obj scopeObj) string {
+	switch obj.kind {
+	case ast.Pkg:
+		return strconv.Quote(obj.pkg.path)
+	case ast.Typ:
+		return declString(obj.kind, obj.name, obj.typ)
+	}
+	if t := x.objType(query, obj); t.expr != nil {
+		return types.ExprString(t.expr)
+	}
+	return ""
 }
 
 // scope builds a map of in-scope names at the end of the given path.
 // E.g. var Name int will add the key "Name" to the returned map.
+//
+// Local names are in scope after their declaration, so the
+// statement at the end of path declares nothing in its own scope.
+// Package-level names are in scope throughout the file.
 func scope(pkgs map[string]*pkgDecl, path []ast.Node) map[string]scopeObj {
+	return scopeOf(pkgs, path, false)
+}
+
+// lookupScope finds the object the identifier at the end of path
+// refers to, or declares.
+func lookupScope(pkgs map[string]*pkgDecl, path []ast.Node) (scopeObj, bool) {
+	id := path[0].(*ast.Ident)
+	if obj, ok := scopeOf(pkgs, path, true)[id.Name]; ok && obj.declPos == id.Pos() {
+		return obj, true
+	}
+	obj, ok := scope(pkgs, path)[id.Name]
+	return obj, ok
+}
+
+// scopeOf builds the scope at the end of path. If self is set the
+// statements on the path declare their names in their own scope,
+// so an identifier being declared can find itself.
+func scopeOf(pkgs map[string]*pkgDecl, path []ast.Node, self bool) map[string]scopeObj {
 	result := make(map[string]scopeObj)
+	level := levelLocal
 
 	add := func(obj scopeObj) {
-		if _, ok := result[obj.name]; !ok {
+		obj.level = level
+		if obj.kind == ast.Pkg {
+			obj.level = levelImported
+		}
+		if obj.level < levelParam {
+			obj.start = token.NoPos
+		}
+		inner, ok := result[obj.name]
+		if !ok {
 			result[obj.name] = obj
+			return
+		}
+		// Shadowed, but keep it to resolve x := x.
+		p := &inner
+		for p.outer != nil {
+			p = p.outer
 		}
+		p.outer = &obj
+		result[obj.name] = inner
 	}
 
 	addAssign := func(s *ast.AssignStmt) {
 		if s.Tok != token.DEFINE {
 			return
 		}
-		for _, lhs := range s.Lhs {
-			if ident, ok := lhs.(*ast.Ident); ok {
-				add(scopeObj{ident.Name, ast.Var, nil})
+		for i, lhs := range s.Lhs {
+			ident, ok := lhs.(*ast.Ident)
+			if !ok {
+				continue
+			}
+			obj := scopeObj{name: ident.Name, kind: ast.Var, declPos: ident.Pos(), start: s.End()}
+			if len(s.Lhs) == len(s.Rhs) {
+				obj.val = s.Rhs[i]
+			} else if len(s.Rhs) == 1 {
+				obj.val, obj.valIndex = s.Rhs[0], i
+			}
+			add(obj)
+		}
+	}
+
+	addRange := func(s *ast.RangeStmt) {
+		if s.Tok != token.DEFINE {
+			return
+		}
+		for i, e := range []ast.Expr{s.Key, s.Value} {
+			if ident, ok := e.(*ast.Ident); ok && ident.Name != "_" {
+				add(scopeObj{name: ident.Name, kind: ast.Var, val: s.X, valIndex: i, ranged: true, declPos: ident.Pos(), start: s.Body.Pos()})
+			}
+		}
+	}
+
+	// addTypeCase adds the variable bound by a type switch, as
+	// v in switch v := x.(type). In a clause listing a single
+	// type, v has that type. Otherwise it has the type of x.
+	addTypeCase := func(clause *ast.CaseClause, sw *ast.TypeSwitchStmt) {
+		s, ok := sw.Assign.(*ast.AssignStmt)
+		if !ok || len(s.Lhs) != 1 || len(s.Rhs) != 1 {
+			return
+		}
+		ident, ok := s.Lhs[0].(*ast.Ident)
+		if !ok {
+			return
+		}
+		obj := scopeObj{name: ident.Name, kind: ast.Var, declPos: ident.Pos(), start: clause.Colon}
+		if assert, ok := s.Rhs[0].(*ast.TypeAssertExpr); ok {
+			obj.val = assert.X
+		}
+		if len(clause.List) == 1 {
+			if id, ok := clause.List[0].(*ast.Ident); !ok || id.Name != "nil" {
+				obj.typ, obj.val = clause.List[0], nil
+			}
+		}
+		add(obj)
+	}
+
+	addFields := func(fields *ast.FieldList, kind ast.ObjKind) {
+		if fields == nil {
+			return
+		}
+		for _, field := range fields.List {
+			for _, ident := range field.Names {
+				if ident.Name == "_" {
+					continue
+				}
+				// The type of a var, or constraint of a type parameter.
+				add(scopeObj{name: ident.Name, kind: kind, typ: field.Type, declPos: ident.Pos()})
 			}
 		}
 	}
 
+	// addRecvTypeParams adds the type parameters of a generic
+	// receiver, as T in func (l *List[T]) Len() int, constrained
+	// as in the declaration of the receiver type.
+	addRecvTypeParams := func(recv *ast.FieldList) {
+		if recv == nil || len(recv.List) != 1 {
+			return
+		}
+		e := recv.List[0].Type
+		if star, ok := e.(*ast.StarExpr); ok {
+			e = star.X
+		}
+		var base ast.Expr
+		var params []ast.Expr
+		switch e := e.(type) {
+		case *ast.IndexExpr:
+			base, params = e.X, []ast.Expr{e.Index}
+		case *ast.IndexListExpr:
+			base, params = e.X, e.Indices
+		default:
+			return
+		}
+		file, _ := path[len(path)-1].(*ast.File)
+		constraints := typeParamConstraints(file, base)
+		for i, p := range params {
+			ident, ok := p.(*ast.Ident)
+			if !ok || ident.Name == "_" {
+				continue
+			}
+			obj := scopeObj{name: ident.Name, kind: ast.Typ, declPos: ident.Pos()}
+			if i < len(constraints) {
+				obj.typ = constraints[i]
+			}
+			add(obj)
+		}
+	}
+
+	addFunc := func(recv *ast.FieldList, ft *ast.FuncType) {
+		level = levelParam
+		addFields(recv, ast.Var)
+		addRecvTypeParams(recv)
+		addFields(ft.TypeParams, ast.Typ)
+		addFields(ft.Params, ast.Var)
+		addFields(ft.Results, ast.Var)
+		level = levelLocal
+	}
+
 	addGenDecl := func(decl *ast.GenDecl) {
 		for _, spec := range decl.Specs {
 			switch spec := spec.(type) {
@@ -55,58 +238,116 @@ func scope(pkgs map[string]*pkgDecl, path []ast.Node) map[string]scopeObj {
 				if spec.Name != nil {
 					name = spec.Name.Name
 				}
-				add(scopeObj{name, ast.Pkg, pkg})
+				add(scopeObj{name: name, kind: ast.Pkg, pkg: pkg, declPos: spec.Pos()})
 			case *ast.ValueSpec:
-				for _, ident := range spec.Names {
-					add(scopeObj{ident.Name, ast.Var, nil})
+				kind := ast.Var
+				if decl.Tok == token.CONST {
+					kind = ast.Con
+				}
+				for i, ident := range spec.Names {
+					obj := scopeObj{name: ident.Name, kind: kind, typ: spec.Type, declPos: ident.Pos(), start: spec.End()}
+					if len(spec.Names) == len(spec.Values) {
+						obj.val = spec.Values[i]
+					} else if len(spec.Values) == 1 {
+						obj.val, obj.valIndex = spec.Values[0], i
+					}
+					add(obj)
 				}
 			case *ast.TypeSpec:
-				add(scopeObj{spec.Name.Name, ast.Typ, nil})
+				add(scopeObj{name: spec.Name.Name, kind: ast.Typ, typ: spec.Type, declPos: spec.Name.Pos(), start: spec.Name.Pos()})
+			}
+		}
+	}
+
+	// addStmts adds the declarations in list before child,
+	// nearest first.
+	addStmts := func(list []ast.Stmt, child ast.Node) {
+		end := 0
+		for j, s := range list {
+			if s == child {
+				end = j
+				if self {
+					end++
+				}
+				break
+			}
+		}
+		for j := end - 1; j >= 0; j-- {
+			switch s := list[j].(type) {
+			case *ast.DeclStmt:
+				addGenDecl(s.Decl.(*ast.GenDecl))
+			case *ast.AssignStmt:
+				addAssign(s)
 			}
 		}
 	}
 
 	// Walk up, building the scope inside-out.
 	for i, n := range path[1:] {
+		child := path[i]
+		// outside reports whether the child is outside the scope
+		// of the names declared by stmt.
+		outside := func(stmt ast.Node) bool {
+			return !self && child == stmt
+		}
 		switch n := n.(type) {
 		case *ast.BlockStmt:
-			for j := len(n.List) - 1; j >= 0; j-- {
-				if n.List[j] == path[i-1] {
-					// stop when we reach the next step in the path
-					break
-				}
-				switch s := n.List[j].(type) {
-				case *ast.DeclStmt:
-					addGenDecl(s.Decl.(*ast.GenDecl))
-
-				case *ast.AssignStmt:
-					addAssign(s)
-				}
-			}
+			addStmts(n.List, child)
 		case *ast.IfStmt:
-			if s, ok := n.Init.(*ast.AssignStmt); ok {
+			if s, ok := n.Init.(*ast.AssignStmt); ok && !outside(s) {
 				addAssign(s)
 			}
 		case *ast.TypeSwitchStmt:
-			if s, ok := n.Assign.(*ast.AssignStmt); ok {
+			if s, ok := n.Assign.(*ast.AssignStmt); ok && (self || child == n.Body) {
+				addAssign(s)
+			}
+			if s, ok := n.Init.(*ast.AssignStmt); ok && !outside(s) {
 				addAssign(s)
 			}
 		case *ast.SwitchStmt:
-			if s, ok := n.Init.(*ast.AssignStmt); ok {
+			if s, ok := n.Init.(*ast.AssignStmt); ok && !outside(s) {
+				addAssign(s)
+			}
+		case *ast.CaseClause:
+			if child.Pos() < n.Colon {
+				// In the list of cases.
+				break
+			}
+			addStmts(n.Body, child)
+			if i+3 < len(path) {
+				// The clause is in the body of its switch.
+				if sw, ok := path[i+3].(*ast.TypeSwitchStmt); ok {
+					addTypeCase(n, sw)
+				}
+			}
+		case *ast.CommClause:
+			addStmts(n.Body, child)
+			if s, ok := n.Comm.(*ast.AssignStmt); ok && !outside(s) {
+				addAssign(s)
+			}
+		case *ast.ForStmt:
+			if s, ok := n.Init.(*ast.AssignStmt); ok && !outside(s) {
 				addAssign(s)
 			}
-			/* TODO
-			case *ast.CaseClause:
-			case *ast.Stmt:
-				// for statement
-				// switch statement
-			case *ast.CommClause:
-				// ?
-			*/
+		case *ast.RangeStmt:
+			if self || child == n.Body {
+				addRange(n)
+			}
+		case *ast.FuncDecl:
+			addFunc(n.Recv, n.Type)
+		case *ast.FuncLit:
+			addFunc(nil, n.Type)
 		case *ast.File:
+			level = levelPackage
 			for _, d := range n.Decls {
-				if genDecl, ok := d.(*ast.GenDecl); ok {
-					addGenDecl(genDecl)
+				switch d := d.(type) {
+				case *ast.GenDecl:
+					addGenDecl(d)
+				case *ast.FuncDecl:
+					// Methods are found through their receiver.
+					if d.Recv == nil && d.Name.Name != "init" && d.Name.Name != "_" {
+						add(scopeObj{name: d.Name.Name, kind: ast.Fun, typ: d.Type, declPos: d.Name.Pos()})
+					}
 				}
 			}
 		default:
@@ -116,3 +357,33 @@ func scope(pkgs map[string]*pkgDecl, path []ast.Node) map[string]scopeObj {
 
 	return result
 }
+
+// typeParamConstraints returns the constraints of the type
+// parameters of the type named by base, if it is declared in
+// file, in order.
+func typeParamConstraints(file *ast.File, base ast.Expr) []ast.Expr {
+	id, ok := base.(*ast.Ident)
+	if file == nil || !ok {
+		return nil
+	}
+	for _, d := range file.Decls {
+		d, ok := d.(*ast.GenDecl)
+		if !ok || d.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range d.Specs {
+			spec := spec.(*ast.TypeSpec)
+			if spec.Name.Name != id.Name || spec.TypeParams == nil {
+				continue
+			}
+			var res []ast.Expr
+			for _, field := range spec.TypeParams.List {
+				for range field.Names {
+					res = append(res, field.Type)
+				}
+			}
+			return res
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gofill
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strings"
+)
+
+// addSiblings adds the other files of the queried file's
+// directory to fset, before the queried file is parsed into it:
+// the non-test .go files built by the default build context. It
+// returns the parsed files.
+func (x *Index) addSiblings(fset *token.FileSet, filename string) []*ast.File {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	c := x.siblingDir(absPath(dir))
+	if c == nil {
+		return nil
+	}
+	var files []*ast.File
+	for _, f := range c.files {
+		tf := c.fset.File(f.Package)
+		if filepath.Base(tf.Name()) == base {
+			continue
+		}
+		// The files are in order of base, so they keep their
+		// positions in fset.
+		fset.AddFile(tf.Name(), tf.Base(), tf.Size()).SetLines(tf.Lines())
+		files = append(files, f)
+	}
+	return files
+}
+
+// loadSiblings indexes the files from addSiblings with the same
+// package clause as the queried file. Their declarations, exported
+// or not, make up query.local.
+func (x *Index) loadSiblings(query *queryState, filename string, files []*ast.File) {
+	dir := filepath.Dir(filename)
+	indexer := &Indexer{Fset: query.fset}
+	for _, f := range files {
+		if f.Name.Name != query.f.Name.Name {
+			continue
+		}
+		indexer.AddFile(dir, f)
+		query.siblings = append(query.siblings, f)
+	}
+	query.local = indexer.pkgs[dir]
+}
+
+// A siblingCache holds the parsed files of a directory for
+// addSiblings, so they are not parsed again for every query.
+type siblingCache struct {
+	fset   *token.FileSet
+	files  []*ast.File
+	stamps map[string]fileStamp // file name -> stamp when parsed
+}
+
+// A fileStamp tells whether a file has changed since it was parsed.
+type fileStamp struct {
+	modTime  int64 // in nanoseconds
+	size     int64
+	overlaid bool
+	src      string // in the overlay
+}
+
+// siblingDir returns the parsed files of dir, parsing them again
+// if any file has been added, removed or changed, on disk or in
+// the overlay.
+func (x *Index) siblingDir(dir string) *siblingCache {
+	entries, err := x.readDir(dir)
+	if err != nil {
+		return nil
+	}
+	stamps := make(map[string]fileStamp)
+	for _, fi := range entries {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		src, overlaid := x.source(filepath.Join(dir, name)).(string)
+		stamps[name] = fileStamp{fi.ModTime().UnixNano(), fi.Size(), overlaid, src}
+	}
+
+	x.siblingsMu.Lock()
+	c := x.siblings[dir]
+	x.siblingsMu.Unlock()
+	if c != nil && sameStamps(c.stamps, stamps) {
+		return c
+	}
+
+	c = &siblingCache{fset: token.NewFileSet(), stamps: stamps}
+	ctxt := x.buildContext()
+	for _, fi := range entries {
+		name := fi.Name()
+		stamp, ok := stamps[name]
+		if !ok {
+			continue
+		}
+		if ok, err := ctxt.MatchFile(dir, name); err != nil || !ok {
+			continue
+		}
+		var src interface{}
+		if stamp.overlaid {
+			src = stamp.src
+		}
+		f, _ := parser.ParseFile(c.fset, filepath.Join(dir, name), src, parser.ParseComments)
+		if f != nil && f.Package.IsValid() {
+			c.files = append(c.files, f)
+		}
+	}
+
+	x.siblingsMu.Lock()
+	defer x.siblingsMu.Unlock()
+	if x.siblings == nil {
+		x.siblings = make(map[string]*siblingCache)
+	}
+	x.siblings[dir] = c
+	return c
+}
+
+func sameStamps(a, b map[string]fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, s := range a {
+		if t, ok := b[name]; !ok || s != t {
+			return false
+		}
+	}
+	return true
+}
+
+// localDecl finds a top-level declaration in a sibling file.
+func (query *queryState) localDecl(name string) *decl {
+	if query.local == nil {
+		return nil
+	}
+	return query.local.lookup(name)
+}
+
+// visible reports whether a name declared in file can be used
+// from the queried file.
+func (query *queryState) visible(file *fileInfo, name string) bool {
+	return file == nil || file.pkg == query.local || ast.IsExported(name)
+}
+
+// inFile reports whether pos is in the queried file, rather
+// than a sibling.
+func (query *queryState) inFile(pos token.Pos) bool {
+	return pos.IsValid() && query.fset.File(pos) == query.fset.File(query.f.Pos())
+}
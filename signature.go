@@ -0,0 +1,208 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gofill
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strings"
+)
+
+// Signature describes the function being called when the
+// cursor is inside the arguments of a call.
+type Signature struct {
+	Name   string
+	Type   string   // e.g. "func(s string, count int) string"
+	Params []string // e.g. {"s string", "count int"}
+	Active int      // index into Params of the argument at the cursor
+	Doc    string   `json:",omitempty"`
+}
+
+// enclosingCall finds the innermost call whose argument list
+// contains the cursor.
+func (query *queryState) enclosingCall() *ast.CallExpr {
+	for _, n := range query.path {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			continue
+		}
+		if call.Lparen < query.cursor && (!call.Rparen.IsValid() || query.cursor <= call.Rparen) {
+			return call
+		}
+	}
+	return nil
+}
+
+// activeArg counts the commas separating the arguments
+// of call that precede the cursor.
+func (query *queryState) activeArg(call *ast.CallExpr) int {
+	active := 0
+	for i, arg := range call.Args {
+		if arg.End() > query.cursor {
+			break
+		}
+		next := query.cursor
+		if i+1 < len(call.Args) && call.Args[i+1].Pos() < next {
+			next = call.Args[i+1].Pos()
+		}
+		start, end := query.offsetOf(arg.End()), query.offsetOf(next)
+		if start < 0 || end > len(query.src) || start > end {
+			break
+		}
+		if strings.Contains(query.src[start:end], ",") {
+			active = i + 1
+		}
+	}
+	return active
+}
+
+func (x *Index) signatureHelp(query *queryState) {
+	call := query.enclosingCall()
+	if call == nil {
+		return
+	}
+	var name string
+	switch fn := call.Fun.(type) {
+	case *ast.Ident:
+		name = fn.Name
+	case *ast.SelectorExpr:
+		name = fn.Sel.Name
+	default:
+		return
+	}
+
+	var sig *Signature
+	if query.info != nil {
+		sig = x.typedSignature(query, call.Fun)
+	}
+	if sig == nil {
+		sig = x.declSignature(query, call.Fun)
+	}
+	if sig == nil {
+		return
+	}
+	sig.Name = name
+	sig.Active = query.activeArg(call)
+	if n := len(sig.Params); sig.Active >= n && n > 0 && strings.Contains(sig.Params[n-1], "...") {
+		sig.Active = n - 1
+	}
+	query.res.Signature = sig
+}
+
+// declSignature resolves the callee syntactically.
+func (x *Index) declSignature(query *queryState, fun ast.Expr) *Signature {
+	var doc string
+	var t typeExpr
+	if id, ok := fun.(*ast.Ident); ok {
+		if obj, ok := query.scope[id.Name]; ok && obj.kind == ast.Fun {
+			doc, t = query.localDoc(obj.declPos), typeExpr{expr: obj.typ}
+		}
+	}
+	if sel, ok := fun.(*ast.SelectorExpr); ok && t.expr == nil {
+		if id, ok := sel.X.(*ast.Ident); ok {
+			if pkg := x.importedPkg(query, nil, id.Name); pkg != nil {
+				if d := pkg.lookup(sel.Sel.Name); d != nil && d.kind == ast.Fun {
+					doc, t = d.doc, x.declType(query, d)
+				}
+			}
+		}
+		if t.expr == nil {
+			for _, m := range x.members(query, x.exprType(query, sel.X, nil)) {
+				if m.name == sel.Sel.Name {
+					doc, t = m.doc, x.declType(query, m)
+					break
+				}
+			}
+		}
+	}
+	if t.expr == nil {
+		t = x.exprType(query, fun, nil)
+	}
+	ft, ok := x.underlying(query, t).expr.(*ast.FuncType)
+	if !ok {
+		return nil
+	}
+	sig := &Signature{
+		Type: types.ExprString(ft),
+		Doc:  doc,
+	}
+	for _, field := range ft.Params.List {
+		typ := types.ExprString(field.Type)
+		if len(field.Names) == 0 {
+			sig.Params = append(sig.Params, typ)
+		}
+		for _, name := range field.Names {
+			sig.Params = append(sig.Params, name.Name+" "+typ)
+		}
+	}
+	return sig
+}
+
+// typedSignature resolves the callee with go/types.
+func (x *Index) typedSignature(query *queryState, fun ast.Expr) *Signature {
+	tv, ok := query.info.Types[fun]
+	if !ok {
+		return nil
+	}
+	s, ok := tv.Type.Underlying().(*types.Signature)
+	if !ok {
+		return nil
+	}
+	qual := types.RelativeTo(query.pkg)
+	sig := &Signature{
+		Type: types.TypeString(s, qual),
+	}
+	var id *ast.Ident
+	switch fun := fun.(type) {
+	case *ast.Ident:
+		id = fun
+	case *ast.SelectorExpr:
+		id = fun.Sel
+	}
+	if obj := query.info.Uses[id]; obj != nil {
+		switch {
+		case obj.Pkg() == query.pkg && query.inFile(obj.Pos()):
+			sig.Doc = query.localDoc(obj.Pos())
+		case obj.Pkg() == query.pkg:
+			if s.Recv() != nil {
+				break // methods are not in localDecl
+			}
+			if d := query.localDecl(obj.Name()); d != nil {
+				sig.Doc = d.doc // in a sibling file
+			}
+		default:
+			sig.Doc = x.objDoc(obj)
+		}
+	}
+	params := s.Params()
+	for i := 0; i < params.Len(); i++ {
+		p := params.At(i)
+		typ := types.TypeString(p.Type(), qual)
+		if slice, ok := p.Type().(*types.Slice); ok && s.Variadic() && i == params.Len()-1 {
+			typ = "..." + types.TypeString(slice.Elem(), qual)
+		}
+		if p.Name() != "" {
+			typ = p.Name() + " " + typ
+		}
+		sig.Params = append(sig.Params, typ)
+	}
+	return sig
+}
+
+// offsetOf returns the byte offset of p in the source as it
+// was given to Query, without any fake identifier.
+func (query *queryState) offsetOf(p token.Pos) int {
+	off := query.fset.Position(p).Offset
+	if query.fake && off > query.offset {
+		off--
+	}
+	return off
+}
+
+// rangeOf returns the source range of n.
+func (query *queryState) rangeOf(n ast.Node) Range {
+	return Range{query.offsetOf(n.Pos()), query.offsetOf(n.End())}
+}
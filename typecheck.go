@@ -0,0 +1,339 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gofill
+
+import (
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path"
+	"path/filepath"
+	"strconv"
+)
+
+// typesImporter imports packages for go/types by type checking
+// their source. Errors are ignored, so a broken or missing
+// dependency produces an incomplete package rather than failing
+// the whole query.
+type typesImporter struct {
+	x *Index
+}
+
+type typesEntry struct {
+	done chan struct{} // closed once pkg is loaded
+	pkg  *types.Package
+}
+
+func (imp typesImporter) Import(path string) (*types.Package, error) {
+	return imp.ImportFrom(path, "", 0)
+}
+
+func (imp typesImporter) ImportFrom(importPath, dir string, mode types.ImportMode) (*types.Package, error) {
+	if importPath == "unsafe" {
+		return types.Unsafe, nil
+	}
+	x := imp.x
+	ctxt := x.buildContext()
+	var bp *build.Package
+	var err error
+	if pkg := x.pkgs[importPath]; pkg != nil && pkg.dir != "" {
+		// Indexed, perhaps from the module cache, so we
+		// need not ask the go command where it is.
+		bp, err = ctxt.ImportDir(pkg.dir, 0)
+		if bp != nil {
+			bp.ImportPath = importPath
+		}
+	} else {
+		bp, err = ctxt.Import(importPath, dir, 0)
+	}
+	key := importPath
+	if err == nil {
+		key = bp.ImportPath
+	}
+
+	x.typesMu.Lock()
+	if x.typesPkgs == nil {
+		x.typesPkgs = make(map[string]*typesEntry)
+	}
+	e := x.typesPkgs[key]
+	if e != nil {
+		x.typesMu.Unlock()
+		select {
+		case <-e.done:
+			return e.pkg, nil
+		default:
+			// Still loading, perhaps further up this import
+			// cycle. Waiting for it could deadlock.
+			return imp.fake(key), nil
+		}
+	}
+	e = &typesEntry{done: make(chan struct{})}
+	x.typesPkgs[key] = e
+	x.typesMu.Unlock()
+
+	if err != nil {
+		e.pkg = imp.fake(key)
+	} else {
+		e.pkg = imp.load(bp)
+	}
+	close(e.done)
+	return e.pkg, nil
+}
+
+// fake returns an empty, complete package standing in for one
+// we cannot find.
+func (imp typesImporter) fake(importPath string) *types.Package {
+	name := path.Base(importPath)
+	if pkg := imp.x.pkgs[importPath]; pkg != nil {
+		name = pkg.shortName
+	}
+	pkg := types.NewPackage(importPath, name)
+	pkg.MarkComplete()
+	return pkg
+}
+
+func (imp typesImporter) load(bp *build.Package) *types.Package {
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, name := range append(bp.GoFiles, bp.CgoFiles...) {
+		filename := filepath.Join(bp.Dir, name)
+		f, _ := parser.ParseFile(fset, filename, imp.x.source(filename), 0)
+		if f != nil {
+			files = append(files, f)
+		}
+	}
+	conf := types.Config{
+		Importer:         imp,
+		IgnoreFuncBodies: true,
+		FakeImportC:      true,
+		Error:            func(error) {},
+	}
+	pkg, _ := conf.Check(bp.ImportPath, fset, files, nil)
+	return pkg
+}
+
+// typeCheck runs go/types over the query file. Errors are
+// expected, as the file is usually incomplete.
+func (x *Index) typeCheck(query *queryState) {
+	conf := types.Config{
+		Importer:    typesImporter{x},
+		FakeImportC: true,
+		Error:       func(error) {},
+	}
+	query.info = &types.Info{
+		Types: make(map[ast.Expr]types.TypeAndValue),
+		Defs:  make(map[*ast.Ident]types.Object),
+		Uses:  make(map[*ast.Ident]types.Object),
+
+		Implicits: make(map[ast.Node]types.Object),
+	}
+	files := append([]*ast.File{query.f}, query.siblings...)
+	query.pkg, _ = conf.Check(query.f.Name.Name, query.fset, files, query.info)
+}
+
+// typedSelectorSearch completes sel using type information.
+// It reports false if the type of the operand is unknown, in
+// which case the caller should fall back to syntactic search.
+func (x *Index) typedSelectorSearch(query *queryState, sel *ast.SelectorExpr, name string) bool {
+	if query.info == nil {
+		return false
+	}
+	if id, ok := sel.X.(*ast.Ident); ok {
+		if pkgName, ok := query.info.Uses[id].(*types.PkgName); ok {
+			scope := pkgName.Imported().Scope()
+			var objs []types.Object
+			for _, n := range scope.Names() {
+				objs = append(objs, scope.Lookup(n))
+			}
+			x.objSearch(query, objs, name)
+			return true
+		}
+	}
+	tv, ok := query.info.Types[sel.X]
+	if !ok || tv.Type == nil || tv.Type == types.Typ[types.Invalid] {
+		return false
+	}
+	if tv.IsType() {
+		// Method expression.
+		mset := types.NewMethodSet(tv.Type)
+		var objs []types.Object
+		for i := 0; i < mset.Len(); i++ {
+			objs = append(objs, mset.At(i).Obj())
+		}
+		x.objSearch(query, objs, name)
+		return true
+	}
+	x.objSearch(query, typedMembers(tv.Type, tv.Addressable()), name)
+	return true
+}
+
+// typedMembers returns the fields and methods selectable on a
+// value of type T.
+func typedMembers(T types.Type, addressable bool) []types.Object {
+	var res []types.Object
+	seen := make(map[string]bool)
+	add := func(obj types.Object) {
+		if !seen[obj.Name()] {
+			seen[obj.Name()] = true
+			res = append(res, obj)
+		}
+	}
+
+	mset := types.NewMethodSet(T)
+	if _, isPtr := T.Underlying().(*types.Pointer); addressable && !isPtr && !types.IsInterface(T) {
+		mset = types.NewMethodSet(types.NewPointer(T))
+	}
+	for i := 0; i < mset.Len(); i++ {
+		add(mset.At(i).Obj())
+	}
+
+	// Walk embedded structs breadth first, so that
+	// shallower fields shadow deeper ones.
+	var structs []*types.Struct
+	if st, ok := deref(T).Underlying().(*types.Struct); ok {
+		structs = append(structs, st)
+	}
+	for depth := 0; len(structs) > 0 && depth < maxTypeDepth; depth++ {
+		var next []*types.Struct
+		for _, st := range structs {
+			for i := 0; i < st.NumFields(); i++ {
+				f := st.Field(i)
+				add(f)
+				if !f.Anonymous() {
+					continue
+				}
+				if st, ok := deref(f.Type()).Underlying().(*types.Struct); ok {
+					next = append(next, st)
+				}
+			}
+		}
+		structs = next
+	}
+	return res
+}
+
+func deref(T types.Type) types.Type {
+	if p, ok := T.Underlying().(*types.Pointer); ok {
+		return p.Elem()
+	}
+	return T
+}
+
+func (x *Index) objSearch(query *queryState, objs []types.Object, name string) {
+	for _, obj := range objs {
+		if !obj.Exported() && obj.Pkg() != query.pkg {
+			continue
+		}
+		if obj.Name() == name {
+			query.res.Suggest = nil
+			return
+		}
+		score, matched := match(name, obj.Name())
+		if score == 0 {
+			continue
+		}
+		level, declPos := levelImported, token.NoPos
+		if obj.Pkg() != nil && obj.Pkg() == query.pkg {
+			level = levelPackage
+			if obj.Parent() == query.pkg.Scope() {
+				declPos = obj.Pos()
+			}
+		}
+		query.suggest(Suggestion{
+			Range:   query.pos,
+			Name:    obj.Name(),
+			Kind:    objKind(obj),
+			Type:    objString(obj, query.pkg),
+			Doc:     x.objDoc(obj),
+			Matches: matched,
+		}, score, level, declPos)
+	}
+}
+
+// objKind is kindName for go/types objects.
+func objKind(obj types.Object) string {
+	switch obj := obj.(type) {
+	case *types.PkgName:
+		return "package"
+	case *types.Const:
+		return "const"
+	case *types.TypeName:
+		return "type"
+	case *types.Var:
+		if obj.IsField() {
+			return "field"
+		}
+		return "var"
+	case *types.Func:
+		if obj.Type().(*types.Signature).Recv() != nil {
+			return "method"
+		}
+		return "func"
+	}
+	return ""
+}
+
+// objString is declString for go/types objects.
+func objString(obj types.Object, from *types.Package) string {
+	qual := types.RelativeTo(from)
+	switch obj := obj.(type) {
+	case *types.PkgName:
+		return strconv.Quote(obj.Imported().Path())
+	case *types.TypeName:
+		switch obj.Type().Underlying().(type) {
+		case *types.Struct:
+			return "type " + obj.Name() + " struct"
+		case *types.Interface:
+			return "type " + obj.Name() + " interface"
+		}
+		return "type " + obj.Name() + " " + types.TypeString(obj.Type().Underlying(), qual)
+	case *types.Func:
+		// Drop the receiver.
+		sig := obj.Type().(*types.Signature)
+		sig = types.NewSignatureType(nil, nil, nil, sig.Params(), sig.Results(), sig.Variadic())
+		return types.TypeString(sig, qual)
+	}
+	return types.TypeString(obj.Type(), qual)
+}
+
+// objDoc finds the documentation of obj in the index.
+func (x *Index) objDoc(obj types.Object) string {
+	if d := x.objDecl(obj); d != nil {
+		return d.doc
+	}
+	return ""
+}
+
+// objDecl finds the package-level declaration or method obj
+// in the index.
+func (x *Index) objDecl(obj types.Object) *decl {
+	if obj.Pkg() == nil {
+		return nil
+	}
+	pkg := x.pkgs[obj.Pkg().Path()]
+	if pkg == nil {
+		return nil
+	}
+	if fn, ok := obj.(*types.Func); ok {
+		if recv := fn.Type().(*types.Signature).Recv(); recv != nil {
+			named, ok := deref(recv.Type()).(*types.Named)
+			if !ok {
+				return nil
+			}
+			for _, m := range pkg.methods[named.Obj().Name()] {
+				if m.name == fn.Name() {
+					return m
+				}
+			}
+			return nil
+		}
+	}
+	if obj.Parent() != obj.Pkg().Scope() {
+		return nil
+	}
+	return pkg.lookup(obj.Name())
+}